@@ -0,0 +1,46 @@
+package consul
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/hashicorp/consul/api"
+	"io/ioutil"
+)
+
+// ExportRegistrations - writes registrations made by this broker to a JSON file for RegisterFromFile.
+// ACL tokens are not written, restored services use the agent default token.
+func (b *broker) ExportRegistrations(path string) error {
+	b.Lock()
+	payload, err := json.MarshalIndent(b.services, "", "  ")
+	b.Unlock()
+	if err != nil {
+		return err
+	}
+
+	if err := ioutil.WriteFile(path, payload, 0600); err != nil {
+		return fmt.Errorf("can not export registrations to %s, got error %v", path, err)
+	}
+
+	return nil
+}
+
+// RegisterFromFile - registers services exported by ExportRegistrations
+func (b *broker) RegisterFromFile(path string) error {
+	payload, err := ioutil.ReadFile(path)
+	if err != nil {
+		return fmt.Errorf("can not read registrations from %s, got error %v", path, err)
+	}
+
+	var registrations []*api.AgentServiceRegistration
+	if err := json.Unmarshal(payload, &registrations); err != nil {
+		return fmt.Errorf("can not parse registrations from %s, got error %v", path, err)
+	}
+
+	for _, serviceRegData := range registrations {
+		if err := b.register(serviceRegData, ""); err != nil {
+			return fmt.Errorf("can not register service %s in consul %v", serviceRegData.ID, err)
+		}
+	}
+
+	return nil
+}
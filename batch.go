@@ -0,0 +1,53 @@
+package consul
+
+import (
+	"fmt"
+)
+
+// BatchPolicy - how RegisterBatch handles failed registrations
+type BatchPolicy int
+
+const (
+	// BatchBestEffort - registers every service it can and reports all failures
+	BatchBestEffort BatchPolicy = iota
+	// BatchAllOrNothing - stops at the first failure and deregisters services the batch registered,
+	// services registered by this broker before the batch are kept
+	BatchAllOrNothing
+)
+
+// RegisterBatch - registers services following the policy
+func (b *broker) RegisterBatch(services []Service, policy BatchPolicy) error {
+	var errs []error
+	registered := make([]string, 0, len(services))
+
+	for _, serviceData := range services {
+		// the agent takes the name as ID of a service registered without one
+		serviceID := serviceData.ID
+		if serviceID == "" {
+			serviceID = serviceData.Name
+		}
+
+		existed := b.registration(serviceID) != nil
+		err := b.Register(serviceData)
+		if err == nil {
+			if !existed {
+				registered = append(registered, serviceID)
+			}
+			continue
+		}
+
+		errs = append(errs, fmt.Errorf("can not register service %s in consul %v", serviceID, err))
+		if policy != BatchAllOrNothing {
+			continue
+		}
+
+		for _, serviceID := range registered {
+			if err := b.Deregister(serviceID); err != nil {
+				errs = append(errs, fmt.Errorf("do not roll back consul service %s, got error %v", serviceID, err))
+			}
+		}
+		break
+	}
+
+	return joinErrors(errs...)
+}
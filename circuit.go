@@ -0,0 +1,65 @@
+package consul
+
+import (
+	"errors"
+	"sync"
+	"time"
+)
+
+// ErrCircuitOpen - returned without calling consul while the circuit breaker is open
+var ErrCircuitOpen = errors.New("consul circuit breaker is open")
+
+// circuitBreaker - fails calls fast for cooldown after threshold consecutive failures,
+// then lets a single probe call through to decide whether to close again
+type circuitBreaker struct {
+	threshold int
+	cooldown  time.Duration
+	failures  int
+	openUntil time.Time
+	probing   bool
+	sync.Mutex
+}
+
+// call - runs fn unless the circuit is open, nil breaker always runs it
+func (c *circuitBreaker) call(fn func() error) error {
+	if c == nil {
+		return fn()
+	}
+	if err := c.allow(); err != nil {
+		return err
+	}
+
+	err := fn()
+	c.record(err)
+	return err
+}
+
+func (c *circuitBreaker) allow() error {
+	c.Lock()
+	defer c.Unlock()
+
+	if c.failures < c.threshold {
+		return nil
+	}
+	if c.probing || time.Now().Before(c.openUntil) {
+		return ErrCircuitOpen
+	}
+	c.probing = true
+	return nil
+}
+
+func (c *circuitBreaker) record(err error) {
+	c.Lock()
+	defer c.Unlock()
+
+	c.probing = false
+	if err == nil || !isUnavailable(err) {
+		c.failures = 0
+		return
+	}
+
+	c.failures++
+	if c.failures >= c.threshold {
+		c.openUntil = time.Now().Add(c.cooldown)
+	}
+}
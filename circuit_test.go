@@ -0,0 +1,91 @@
+package consul
+
+import (
+	"errors"
+	"github.com/hashicorp/consul/api"
+	"testing"
+	"time"
+)
+
+func TestCircuitBreaker(t *testing.T) {
+	unavailable := errors.New("connection refused")
+	notFound := api.StatusError{Code: 404, Body: "unknown service"}
+
+	type step struct {
+		wait bool
+		err  error
+		want error
+	}
+	tests := []struct {
+		name  string
+		steps []step
+	}{
+		{name: "closed below threshold", steps: []step{
+			{err: unavailable, want: unavailable},
+			{want: nil},
+			{err: unavailable, want: unavailable},
+			{want: nil},
+		}},
+		{name: "opens at threshold", steps: []step{
+			{err: unavailable, want: unavailable},
+			{err: unavailable, want: unavailable},
+			{want: ErrCircuitOpen},
+		}},
+		{name: "client errors keep it closed", steps: []step{
+			{err: notFound, want: notFound},
+			{err: notFound, want: notFound},
+			{want: nil},
+		}},
+		{name: "successful probe closes", steps: []step{
+			{err: unavailable, want: unavailable},
+			{err: unavailable, want: unavailable},
+			{wait: true, want: nil},
+			{want: nil},
+		}},
+		{name: "failed probe reopens", steps: []step{
+			{err: unavailable, want: unavailable},
+			{err: unavailable, want: unavailable},
+			{wait: true, err: unavailable, want: unavailable},
+			{want: ErrCircuitOpen},
+			{wait: true, want: nil},
+		}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := &circuitBreaker{threshold: 2, cooldown: 20 * time.Millisecond}
+			for i, s := range tt.steps {
+				if s.wait {
+					time.Sleep(30 * time.Millisecond)
+				}
+				if err := c.call(func() error { return s.err }); !errors.Is(err, s.want) {
+					t.Fatalf("step %d got error %v, want %v", i, err, s.want)
+				}
+			}
+		})
+	}
+}
+
+func TestCircuitBreakerSingleProbe(t *testing.T) {
+	c := &circuitBreaker{threshold: 1, cooldown: 20 * time.Millisecond}
+	c.call(func() error { return errors.New("connection refused") })
+	time.Sleep(30 * time.Millisecond)
+
+	if err := c.allow(); err != nil {
+		t.Fatalf("probe got error %v", err)
+	}
+	if err := c.allow(); err != ErrCircuitOpen {
+		t.Errorf("call during probe got error %v, want %v", err, ErrCircuitOpen)
+	}
+}
+
+func TestWithCircuitBreakerThreshold(t *testing.T) {
+	for _, threshold := range []int{0, -1} {
+		if _, err := NewBroker(WithCircuitBreaker(threshold, time.Second)); err == nil {
+			t.Errorf("NewBroker with circuit breaker threshold %d got no error", threshold)
+		}
+	}
+	if _, err := NewBroker(WithCircuitBreaker(1, time.Second)); err != nil {
+		t.Errorf("NewBroker got error %v", err)
+	}
+}
@@ -0,0 +1,96 @@
+package consul
+
+import (
+	"github.com/hashicorp/consul/api"
+	"time"
+)
+
+// Config - settings shared by broker and wrapper, so both layers are configured once.
+// Empty fields keep api.DefaultConfig and package defaults.
+type Config struct {
+	Address    string
+	Scheme     string
+	Token      string
+	Datacenter string
+	Namespace  string
+	TLS        *api.TLSConfig
+
+	// DebugLogger logs registration requests, see WithDebugLogger
+	DebugLogger Logger
+
+	// RegisterAttempts and RegisterBackoff retry wrapper registrations, see WithRegisterRetry
+	RegisterAttempts int
+	RegisterBackoff  time.Duration
+
+	// RequireConsul fails NewWrapperFromConfig when consul is disabled
+	RequireConsul bool
+
+	// Enabled overrides CONSUL_ environment variables, see WithEnabled
+	Enabled *bool
+}
+
+// NewBrokerFromConfig - creates broker from the shared config
+func NewBrokerFromConfig(cfg Config) (Broker, error) {
+	brokerConfig := BrokerConfig{
+		Address:    cfg.Address,
+		Token:      cfg.Token,
+		Datacenter: cfg.Datacenter,
+		Scheme:     cfg.Scheme,
+	}
+
+	return NewBrokerWithConfig(brokerConfig, cfg.brokerOptions()...)
+}
+
+// NewWrapperFromConfig - creates wrapper from the shared config, nil consulBroker is created
+// from the same config when consul is enabled by Enabled or, if it is nil, by the environment
+func NewWrapperFromConfig(listen string, consulBroker Broker, serviceName, serviceID string, cfg Config, opts ...WrapperOption) (Wrapper, error) {
+	if consulBroker == nil && cfg.enabled() {
+		var err error
+		if consulBroker, err = NewBrokerFromConfig(cfg); err != nil {
+			return nil, err
+		}
+	}
+
+	return NewWrapper(listen, consulBroker, serviceName, serviceID, append(cfg.wrapperOptions(), opts...)...)
+}
+
+// enabled - reports whether consul is enabled, with the same rule as GetBroker
+func (c Config) enabled() bool {
+	if c.Enabled != nil {
+		return *c.Enabled
+	}
+	return isUseConsul()
+}
+
+func (c Config) brokerOptions() []Option {
+	opts := make([]Option, 0)
+	if c.Enabled != nil {
+		opts = append(opts, WithEnabled(*c.Enabled))
+	}
+	if c.Namespace != "" {
+		opts = append(opts, WithNamespace(c.Namespace))
+	}
+	if c.TLS != nil {
+		opts = append(opts, WithTLSConfig(*c.TLS))
+	}
+	if c.DebugLogger != nil {
+		opts = append(opts, WithDebugLogger(c.DebugLogger))
+	}
+
+	return opts
+}
+
+func (c Config) wrapperOptions() []WrapperOption {
+	opts := make([]WrapperOption, 0)
+	if c.RegisterAttempts > 0 {
+		opts = append(opts, WithRegisterRetry(c.RegisterAttempts, c.RegisterBackoff))
+	}
+	if c.Enabled != nil {
+		opts = append(opts, WithConsulEnabled(*c.Enabled))
+	}
+	if c.RequireConsul {
+		opts = append(opts, RequireConsul())
+	}
+
+	return opts
+}
@@ -0,0 +1,34 @@
+package consul
+
+import (
+	"fmt"
+	"github.com/hashicorp/consul/api"
+)
+
+// WriteConfigEntry - creates or replaces config entry, e.g. service-defaults or service-resolver,
+// so a service declares its mesh config at startup
+func (b *broker) WriteConfigEntry(entry api.ConfigEntry) error {
+	if entry == nil {
+		return fmt.Errorf("config entry is nil")
+	}
+
+	written, _, err := b.client.ConfigEntries().Set(entry, nil)
+	if err != nil {
+		return fmt.Errorf("can not write config entry %s/%s, got error %v", entry.GetKind(), entry.GetName(), err)
+	}
+	if !written {
+		return fmt.Errorf("config entry %s/%s was not written", entry.GetKind(), entry.GetName())
+	}
+
+	return nil
+}
+
+// DeleteConfigEntry - removes config entry, a missing entry is not an error
+func (b *broker) DeleteConfigEntry(kind, name string) error {
+	_, err := b.client.ConfigEntries().Delete(kind, name, nil)
+	if err != nil && !isNotFound(err) {
+		return fmt.Errorf("can not delete config entry %s/%s, got error %v", kind, name, err)
+	}
+
+	return nil
+}
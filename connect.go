@@ -0,0 +1,223 @@
+package consul
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"github.com/hashicorp/consul/api"
+	"net/url"
+	"strings"
+	"sync"
+)
+
+// connectTLS - leaf certificate and CA roots of a connect service, replaced by the refresh watches
+type connectTLS struct {
+	service   string
+	authorize func(params *api.AgentAuthorizeParams) (*api.AgentAuthorize, error)
+	cert      *tls.Certificate
+	roots     *x509.CertPool
+	sync.RWMutex
+}
+
+// ConnectTLSConfig - returns mTLS config of the connect native service registered by this broker. The leaf
+// certificate and CA roots are fetched from the agent and kept refreshed by blocking queries until ctx is cancelled.
+// Accepted clients are authorized against intentions by the agent, so the agent token needs service:write on it.
+// Dialing clients must set ServerName to the target service name, the server certificate must carry its SPIFFE ID.
+func (b *broker) ConnectTLSConfig(ctx context.Context, serviceID string) (*tls.Config, error) {
+	serviceRegData := b.registration(serviceID)
+	if serviceRegData == nil {
+		return nil, fmt.Errorf("service %s is not registered by this broker", serviceID)
+	}
+	token := b.queryOptions(serviceID).Token
+
+	leaf, leafMeta, err := b.client.Agent().ConnectCALeaf(serviceRegData.Name, (&api.QueryOptions{Token: token}).WithContext(ctx))
+	if err != nil {
+		return nil, fmt.Errorf("can not fetch connect leaf certificate of %s, got error %v", serviceRegData.Name, err)
+	}
+	roots, rootsMeta, err := b.client.Agent().ConnectCARoots((&api.QueryOptions{Token: token}).WithContext(ctx))
+	if err != nil {
+		return nil, fmt.Errorf("can not fetch connect CA roots, got error %v", err)
+	}
+
+	material := &connectTLS{service: serviceRegData.Name, authorize: b.client.Agent().ConnectAuthorize}
+	if err := material.setLeaf(leaf); err != nil {
+		return nil, err
+	}
+	if err := material.setRoots(roots); err != nil {
+		return nil, err
+	}
+
+	go watchLoop(ctx, leafMeta.LastIndex, func(q *api.QueryOptions) (uint64, error) {
+		q.Token = token
+		leaf, meta, err := b.client.Agent().ConnectCALeaf(serviceRegData.Name, q)
+		if err != nil {
+			return 0, err
+		}
+		if err := material.setLeaf(leaf); err != nil {
+			return 0, err
+		}
+		return meta.LastIndex, nil
+	})
+	go watchLoop(ctx, rootsMeta.LastIndex, func(q *api.QueryOptions) (uint64, error) {
+		q.Token = token
+		roots, meta, err := b.client.Agent().ConnectCARoots(q)
+		if err != nil {
+			return 0, err
+		}
+		if err := material.setRoots(roots); err != nil {
+			return 0, err
+		}
+		return meta.LastIndex, nil
+	})
+
+	return material.config(), nil
+}
+
+// setLeaf - replaces the certificate, a broken one keeps the previous
+func (c *connectTLS) setLeaf(leaf *api.LeafCert) error {
+	cert, err := tls.X509KeyPair([]byte(leaf.CertPEM), []byte(leaf.PrivateKeyPEM))
+	if err != nil {
+		return fmt.Errorf("can not parse connect leaf certificate of %s, got error %v", leaf.Service, err)
+	}
+
+	c.Lock()
+	defer c.Unlock()
+
+	c.cert = &cert
+	return nil
+}
+
+// setRoots - replaces the CA roots, an empty list keeps the previous
+func (c *connectTLS) setRoots(roots *api.CARootList) error {
+	pool := x509.NewCertPool()
+	added := 0
+	for _, root := range roots.Roots {
+		if pool.AppendCertsFromPEM([]byte(root.RootCertPEM)) {
+			added++
+		}
+	}
+	if added == 0 {
+		return fmt.Errorf("connect CA roots have no valid certificate")
+	}
+
+	c.Lock()
+	defer c.Unlock()
+
+	c.roots = pool
+	return nil
+}
+
+func (c *connectTLS) certificate() *tls.Certificate {
+	c.RLock()
+	defer c.RUnlock()
+
+	return c.cert
+}
+
+func (c *connectTLS) rootPool() *x509.CertPool {
+	c.RLock()
+	defer c.RUnlock()
+
+	return c.roots
+}
+
+// config - builds config reading the current material on each handshake. Clients skip the standard verification
+// since connect certificates carry SPIFFE URIs instead of host names, verifyServer checks the chain and ID instead.
+func (c *connectTLS) config() *tls.Config {
+	return &tls.Config{
+		MinVersion: tls.VersionTLS12,
+		GetClientCertificate: func(*tls.CertificateRequestInfo) (*tls.Certificate, error) {
+			return c.certificate(), nil
+		},
+		GetConfigForClient: func(*tls.ClientHelloInfo) (*tls.Config, error) {
+			return &tls.Config{
+				MinVersion:       tls.VersionTLS12,
+				Certificates:     []tls.Certificate{*c.certificate()},
+				ClientAuth:       tls.RequireAndVerifyClientCert,
+				ClientCAs:        c.rootPool(),
+				VerifyConnection: c.authorizeClient,
+			}, nil
+		},
+		InsecureSkipVerify: true,
+		VerifyConnection:   c.verifyServer,
+	}
+}
+
+// authorizeClient - asks the agent whether intentions allow the client service to connect this one
+func (c *connectTLS) authorizeClient(state tls.ConnectionState) error {
+	if len(state.PeerCertificates) == 0 {
+		return fmt.Errorf("peer presented no certificate")
+	}
+	cert := state.PeerCertificates[0]
+	uri, err := spiffeID(cert)
+	if err != nil {
+		return err
+	}
+
+	auth, err := c.authorize(&api.AgentAuthorizeParams{
+		Target:           c.service,
+		ClientCertURI:    uri.String(),
+		ClientCertSerial: encodeSerial(cert.SerialNumber.Bytes()),
+	})
+	if err != nil {
+		return fmt.Errorf("can not authorize connection of %s to %s, got error %v", uri, c.service, err)
+	}
+	if !auth.Authorized {
+		return fmt.Errorf("connection of %s to %s is not authorized: %s", uri, c.service, auth.Reason)
+	}
+	return nil
+}
+
+// verifyServer - verifies the server chain against the current connect CA roots and its SPIFFE ID
+// against the service named by the first label of ServerName
+func (c *connectTLS) verifyServer(state tls.ConnectionState) error {
+	certs := state.PeerCertificates
+	if len(certs) == 0 {
+		return fmt.Errorf("peer presented no certificate")
+	}
+	service := strings.SplitN(state.ServerName, ".", 2)[0]
+	if service == "" {
+		return fmt.Errorf("ServerName must be set to the name of the connect service dialed")
+	}
+
+	intermediates := x509.NewCertPool()
+	for _, cert := range certs[1:] {
+		intermediates.AddCert(cert)
+	}
+	if _, err := certs[0].Verify(x509.VerifyOptions{
+		Roots:         c.rootPool(),
+		Intermediates: intermediates,
+		KeyUsages:     []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}); err != nil {
+		return err
+	}
+
+	uri, err := spiffeID(certs[0])
+	if err != nil {
+		return err
+	}
+	if i := strings.LastIndex(uri.Path, "/svc/"); i < 0 || uri.Path[i+len("/svc/"):] != service {
+		return fmt.Errorf("server certificate %s is not issued to service %s", uri, service)
+	}
+	return nil
+}
+
+// spiffeID - returns the spiffe URI connect certificates carry as their identity
+func spiffeID(cert *x509.Certificate) (*url.URL, error) {
+	for _, uri := range cert.URIs {
+		if uri.Scheme == "spiffe" {
+			return uri, nil
+		}
+	}
+	return nil, fmt.Errorf("certificate %s has no spiffe ID", cert.Subject)
+}
+
+// encodeSerial - formats serial number as consul does, colon separated hex bytes
+func encodeSerial(serial []byte) string {
+	parts := make([]string, len(serial))
+	for i, b := range serial {
+		parts[i] = fmt.Sprintf("%02x", b)
+	}
+	return strings.Join(parts, ":")
+}
@@ -0,0 +1,164 @@
+package consul
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/pem"
+	"github.com/hashicorp/consul/api"
+	"math/big"
+	"net"
+	"net/url"
+	"testing"
+	"time"
+)
+
+// testCA - issues connect like leaf certificates with spiffe IDs
+type testCA struct {
+	cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+	pem  string
+}
+
+func newTestCA(t *testing.T) *testCA {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, _ := x509.ParseCertificate(der)
+
+	return &testCA{cert: cert, key: key, pem: string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}))}
+}
+
+func (ca *testCA) leaf(t *testing.T, service string) *api.LeafCert {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	uri, _ := url.Parse("spiffe://11111111.consul/ns/default/dc/dc1/svc/" + service)
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		URIs:         []*url.URL{uri},
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, ca.cert, &key.PublicKey, ca.key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDer, _ := x509.MarshalECPrivateKey(key)
+
+	return &api.LeafCert{
+		Service:       service,
+		CertPEM:       string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})),
+		PrivateKeyPEM: string(pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDer})),
+	}
+}
+
+func (ca *testCA) material(t *testing.T, service string, allowed map[string]bool) *connectTLS {
+	material := &connectTLS{
+		service: service,
+		authorize: func(params *api.AgentAuthorizeParams) (*api.AgentAuthorize, error) {
+			uri, _ := url.Parse(params.ClientCertURI)
+			return &api.AgentAuthorize{Authorized: allowed[uri.Path], Reason: "test intentions"}, nil
+		},
+	}
+	if err := material.setLeaf(ca.leaf(t, service)); err != nil {
+		t.Fatal(err)
+	}
+	if err := material.setRoots(&api.CARootList{Roots: []*api.CARoot{{RootCertPEM: ca.pem}}}); err != nil {
+		t.Fatal(err)
+	}
+	return material
+}
+
+func TestConnectTLSConfig(t *testing.T) {
+	ca := newTestCA(t)
+	server := ca.material(t, "db", map[string]bool{"/ns/default/dc/dc1/svc/web": true})
+
+	listener, err := tls.Listen("tcp", "127.0.0.1:0", server.config())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				if conn.(*tls.Conn).Handshake() == nil {
+					conn.Write([]byte("x"))
+				}
+			}()
+		}
+	}()
+
+	dial := func(client *connectTLS, serverName string) error {
+		config := client.config()
+		config.ServerName = serverName
+		conn, err := tls.DialWithDialer(&net.Dialer{Timeout: time.Second}, "tcp", listener.Addr().String(), config)
+		if err != nil {
+			return err
+		}
+		defer conn.Close()
+
+		conn.SetDeadline(time.Now().Add(time.Second))
+		_, err = conn.Read(make([]byte, 1))
+		return err
+	}
+
+	tests := []struct {
+		name       string
+		client     string
+		serverName string
+		wantErr    bool
+	}{
+		{name: "allowed", client: "web", serverName: "db"},
+		{name: "allowed with domain", client: "web", serverName: "db.service.consul"},
+		{name: "denied by intentions", client: "batch", serverName: "db", wantErr: true},
+		{name: "server of another service", client: "web", serverName: "cache", wantErr: true},
+		{name: "no server name", client: "web", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := dial(ca.material(t, tt.client, nil), tt.serverName)
+			if tt.wantErr && err == nil {
+				t.Error("connection succeeded, want error")
+			}
+			if !tt.wantErr && err != nil {
+				t.Errorf("connection got error %v", err)
+			}
+		})
+	}
+
+	t.Run("other CA", func(t *testing.T) {
+		if err := dial(newTestCA(t).material(t, "web", nil), "db"); err == nil {
+			t.Error("connection of certificate from another CA succeeded")
+		}
+	})
+}
+
+func TestEncodeSerial(t *testing.T) {
+	if serial := encodeSerial([]byte{0x0a, 0xff, 0x01}); serial != "0a:ff:01" {
+		t.Errorf("encodeSerial = %q, want 0a:ff:01", serial)
+	}
+}
@@ -1,81 +1,1074 @@
 package consul
 
 import (
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"fmt"
 	"github.com/hashicorp/consul/api"
+	"log"
+	"sort"
+	"strings"
 	"sync"
+	"time"
 )
 
 // Broker - represents consul broker interface
 type Broker interface {
 	Register(serviceData Service) error
+	RegisterWithResult(serviceData Service) (*RegisterResult, error)
+	RegisterBatch(services []Service, policy BatchPolicy) error
 	Deregister(serviceID string) error
+	DeregisterWithOpts(serviceID string, token, datacenter string) error
+	RunUntil(ctx context.Context) error
 	SendHealthCheck(serviceID string, error string) error
+	SendWarning(serviceID string, note string) error
+	SetMaintenance(serviceID string, enable bool, reason string) error
+	TTLRemaining(checkID string) (time.Duration, error)
+	RegisterCheck(check CheckOptions) error
+	SendCheckHealth(checkID string, error string) error
+	DeregisterCheck(checkID string) error
+	UpdateMeta(serviceID string, meta map[string]string) error
+	SetCheckInterval(checkID string, interval time.Duration) error
+	ExportRegistrations(path string) error
+	RegisterFromFile(path string) error
+	SwapPrimary(key, fromID, toID string) error
+	UpsertIntention(source, destination string, allow bool) error
+	DeleteIntention(source, destination string) error
+	WriteConfigEntry(entry api.ConfigEntry) error
+	DeleteConfigEntry(kind, name string) error
+	PruneCriticalServices(olderThan time.Duration) (int, error)
+	Discover(serviceName string, onlyHealthy bool) ([]ServiceInstance, error)
+	DiscoverInDatacenter(serviceName, datacenter string, onlyHealthy bool) ([]ServiceInstance, error)
+	DiscoverByTag(serviceName, tag string, passingOnly bool) ([]ServiceInstance, error)
+	Resolve(serviceName string) (string, error)
+	ResolveService(name string) (*InstancePicker, error)
+	ServiceHealthScore(serviceName string) (passing, warning, critical int, err error)
+	Datacenters() ([]string, error)
+	IsServerAgent() (bool, error)
+	WatchCatalog(ctx context.Context, onChange func(services map[string][]string))
+	WatchLocalService(ctx context.Context, serviceID string, onMissing func(serviceID string))
+	Watch(serviceName string, tag string) (<-chan []ServiceInstance, func())
+	FireEvent(name string, payload []byte) error
+	WatchEvents(ctx context.Context, name string, onEvent func(payload []byte))
+	LocalServices(filter string) ([]Service, error)
+	LocalHealth(filter string) (map[string]string, error)
+	KVGet(key string) ([]byte, error)
+	KVPut(key string, value []byte) error
+	KVWatch(key string, ch chan<- []byte) (stop func(), err error)
+	KVDelete(key string) error
+	KVList(prefix string) (map[string][]byte, error)
+	WatchKV(prefix string) (<-chan KVUpdate, func())
+	NewLock(key string, opts ...LockOption) (*Lock, error)
+	ConnectTLSConfig(ctx context.Context, serviceID string) (*tls.Config, error)
 }
 
 type CheckOptions struct {
-	HTTP     string
+	ID   string
+	Name string
+	HTTP string
+	TCP  string
+	// Args runs script check, the agent needs enable_local_script_checks
+	Args     []string
 	Interval string
+	Timeout  string
 	TTL      string
+	// Status is the initial status of any check type, consul starts with critical when empty,
+	// passing avoids the critical window of a service already up at registration
+	Status string
+	// AliasService mirrors health of the service, of the one on AliasNode when set.
+	// AliasNode alone mirrors health of the node
+	AliasService string
+	AliasNode    string
+	// DeregisterCriticalServiceAfter makes the agent remove the service once the check was critical that long
+	DeregisterCriticalServiceAfter string
+	// GRPC is host:port/service of the gRPC health protocol, GRPCUseTLS connects with TLS
+	GRPC       string
+	GRPCUseTLS bool
+	// DockerContainerID runs Args in the container with Shell, the agent needs enable_local_script_checks
+	DockerContainerID string
+	Shell             string
+}
+
+// CheckDefaults - check settings Register applies when a check leaves them empty
+type CheckDefaults struct {
+	// TTL turns a service registered without any check into TTL checked one
+	TTL time.Duration
+	// Interval and Timeout apply to polling checks: HTTP, TCP, gRPC, script and docker
+	Interval time.Duration
+	Timeout  time.Duration
 }
 
 type Service struct {
-	Name  string
-	ID    string
-	Port  int
-	Tags  []string
-	Check CheckOptions
+	Name    string
+	ID      string
+	Address string
+	Port    int
+	Tags    []string
+	Meta    map[string]string
+	Weights *Weights
+	// LAN and WAN are tagged addresses for consumers inside and outside the datacenter
+	LAN    *TaggedAddress
+	WAN    *TaggedAddress
+	Check  CheckOptions
+	Checks []CheckOptions
+	Proxy  *ProxyOptions
+	// Connect registers the service in the mesh as connect native or with a sidecar proxy
+	Connect *ConnectOptions
+	// Token is the ACL token of requests for this service instead of the agent default one
+	Token string
+	// EnableTagOverride lets tags changed in the catalog, e.g. by anti-entropy tooling, win over registered ones
+	EnableTagOverride bool
+}
+
+// MetaWithTags - returns Meta merged with key=value tags, Meta wins on conflicts
+func (s Service) MetaWithTags() map[string]string {
+	return MetaWithTags(s.Tags, s.Meta)
+}
+
+// MetaWithTags - returns meta merged with key=value tags, meta wins on conflicts
+func MetaWithTags(tags []string, meta map[string]string) map[string]string {
+	merged := make(map[string]string, len(meta)+len(tags))
+	for _, tag := range tags {
+		pair := strings.SplitN(tag, "=", 2)
+		if len(pair) == 2 && pair[0] != "" {
+			merged[pair[0]] = pair[1]
+		}
+	}
+	for key, value := range meta {
+		merged[key] = value
+	}
+
+	return merged
+}
+
+// TaggedAddress - address of the service on one network, zero Port means the service port
+type TaggedAddress struct {
+	Address string
+	Port    int
+}
+
+// Weights - share of traffic the instance gets in passing and warning state, zero weight excludes it
+type Weights struct {
+	Passing int
+	Warning int
+}
+
+// ProxyOptions - registers the service as connect proxy, Config is passed to the proxy as is (e.g. envoy tuning)
+type ProxyOptions struct {
+	DestinationServiceName string
+	DestinationServiceID   string
+	LocalServiceAddress    string
+	LocalServicePort       int
+	Config                 map[string]interface{}
+}
+
+// ConnectOptions - Native for services terminating mTLS themselves with ConnectTLSConfig,
+// SidecarService registers the sidecar proxy together with the service, the agent rejects both at once
+type ConnectOptions struct {
+	Native         bool
+	SidecarService *SidecarOptions
+}
+
+// SidecarOptions - sidecar proxy of the service, zero Port is assigned by the agent from its sidecar port range
+type SidecarOptions struct {
+	Port      int
+	Tags      []string
+	Upstreams []Upstream
+	Config    map[string]interface{}
+}
+
+// Upstream - service the sidecar exposes to the application on localhost LocalBindPort
+type Upstream struct {
+	DestinationName string
+	Datacenter      string
+	LocalBindPort   int
+}
+
+// DefaultMinTTL - shorter TTL flaps on GC pauses with heartbeat every TTL/2, see WithMinTTL
+const DefaultMinTTL = time.Second
+
+// RegisterResult - what the agent holds after registration. Agent registrations have no raft index,
+// ContentHash identifies the accepted service definition instead.
+type RegisterResult struct {
+	ServiceID   string
+	ContentHash string
+	RequestTime time.Duration
 }
 
 type broker struct {
-	client   *api.Client
-	services []*api.AgentServiceRegistration
+	client        *api.Client
+	agents        []*api.Client
+	services      []*api.AgentServiceRegistration
+	tokens        map[string]string
+	criticalSince map[string]time.Time
+	ttlUpdates    map[string]time.Time
+	ttlStatuses   map[string]string
+	checkTTLs     map[string]time.Duration
+	resolveNext   map[string]int
+	debugLogger   Logger
+	circuit       *circuitBreaker
+	recovery      *recovery
+	minTTL        time.Duration
+	checkDefaults CheckDefaults
+	datacenter    string
+	// enabled is set by WithEnabled, wrappers of the broker follow it instead of CONSUL_ environment variables
+	enabled *bool
 	sync.Mutex
 }
 
-func NewBroker() (Broker, error) {
-	consulClient, err := api.NewClient(api.DefaultConfig())
+// BrokerConfig - agent the broker talks to, empty fields keep api.DefaultConfig values
+type BrokerConfig struct {
+	Address    string
+	Token      string
+	Datacenter string
+	Scheme     string
+}
+
+// NewBroker - creates broker with api.DefaultConfig adjusted by options
+func NewBroker(opts ...Option) (Broker, error) {
+	return NewBrokerWithConfig(BrokerConfig{}, opts...)
+}
+
+// NewBrokerWithConfig - creates broker of the agent in cfg, e.g. one per consul cluster, options apply on top of cfg
+func NewBrokerWithConfig(cfg BrokerConfig, opts ...Option) (Broker, error) {
+	options := &brokerOptions{config: api.DefaultConfig(), minTTL: DefaultMinTTL}
+	if cfg.Address != "" {
+		options.config.Address = cfg.Address
+	}
+	if cfg.Token != "" {
+		options.config.Token = cfg.Token
+	}
+	if cfg.Datacenter != "" {
+		options.config.Datacenter = cfg.Datacenter
+	}
+	if cfg.Scheme != "" {
+		options.config.Scheme = cfg.Scheme
+	}
+	for _, opt := range opts {
+		opt(options)
+	}
+	if options.circuit != nil && options.circuit.threshold < 1 {
+		return nil, fmt.Errorf("circuit breaker threshold %d must be at least 1", options.circuit.threshold)
+	}
+	if options.httpTimeout > 0 {
+		httpClient, err := api.NewHttpClient(options.config.Transport, options.config.TLSConfig)
+		if err != nil {
+			return nil, err
+		}
+		httpClient.Timeout = options.httpTimeout
+		options.config.HttpClient = httpClient
+		if options.config.WaitTime == 0 || options.config.WaitTime > options.httpTimeout/2 {
+			options.config.WaitTime = options.httpTimeout / 2
+		}
+	}
+
+	agents := make([]*api.Client, 0, len(options.agentAddresses))
+	for _, address := range options.agentAddresses {
+		agentConfig := *options.config
+		agentConfig.Address = address
+		agentClient, err := api.NewClient(&agentConfig)
+		if err != nil {
+			return nil, err
+		}
+		agents = append(agents, agentClient)
+	}
+
+	consulClient, err := api.NewClient(options.config)
 	if err != nil {
 		return nil, err
 	}
 
 	return &broker{
-		client:   consulClient,
-		services: make([]*api.AgentServiceRegistration, 0),
+		client:        consulClient,
+		agents:        agents,
+		services:      make([]*api.AgentServiceRegistration, 0),
+		tokens:        make(map[string]string),
+		criticalSince: make(map[string]time.Time),
+		ttlUpdates:    make(map[string]time.Time),
+		ttlStatuses:   make(map[string]string),
+		checkTTLs:     make(map[string]time.Duration),
+		resolveNext:   make(map[string]int),
+		debugLogger:   options.debugLogger,
+		circuit:       options.circuit,
+		recovery:      options.recovery,
+		minTTL:        options.minTTL,
+		checkDefaults: options.checkDefaults,
+		datacenter:    options.config.Datacenter,
+		enabled:       options.enabled,
 	}, nil
 }
 
 // Register - registers service to consul
 func (b *broker) Register(serviceData Service) error {
+	serviceData.Check = b.withDefaults(serviceData.Check)
+	checks := make([]CheckOptions, 0, len(serviceData.Checks))
+	for _, check := range serviceData.Checks {
+		checks = append(checks, b.withDefaults(check))
+	}
+	serviceData.Checks = checks
+
+	if err := ValidateService(serviceData, b.minTTL); err != nil {
+		return err
+	}
+	serviceData, err := assignCheckIDs(serviceData)
+	if err != nil {
+		return fmt.Errorf("invalid checks of service %s: %v", serviceData.ID, err)
+	}
+
+	if err := b.register(newServiceRegistration(serviceData), serviceData.Token); err != nil {
+		return err
+	}
+
+	// a new registration starts from its own initial statuses
+	b.Lock()
+	b.forgetTTLStatuses(serviceData.ID)
+	b.Unlock()
+	return nil
+}
+
+// RegisterWithResult - registers service and reads it back from the agent to confirm what was accepted
+func (b *broker) RegisterWithResult(serviceData Service) (*RegisterResult, error) {
+	if err := b.Register(serviceData); err != nil {
+		return nil, err
+	}
+
+	serviceID := serviceData.ID
+	if serviceID == "" {
+		serviceID = serviceData.Name
+	}
+	agentService, meta, err := b.client.Agent().Service(serviceID, b.queryOptions(serviceID))
+	if err != nil {
+		return nil, fmt.Errorf("service %s is registered, but can not be read back, got error %v", serviceID, err)
+	}
+
+	return &RegisterResult{
+		ServiceID:   agentService.ID,
+		ContentHash: agentService.ContentHash,
+		RequestTime: meta.RequestTime,
+	}, nil
+}
+
+// newServiceRegistration - maps Service to the agent registration payload
+func newServiceRegistration(serviceData Service) *api.AgentServiceRegistration {
 	serviceRegData := &api.AgentServiceRegistration{
-		Name: serviceData.Name,
-		ID:   serviceData.ID,
-		Port: serviceData.Port,
-		Tags: serviceData.Tags,
-		Check: &api.AgentServiceCheck{
-			HTTP:     serviceData.Check.HTTP,
-			Interval: serviceData.Check.Interval,
-			TTL:      serviceData.Check.TTL,
-		},
+		Name:    serviceData.Name,
+		ID:      serviceData.ID,
+		Address: serviceData.Address,
+		Port:    serviceData.Port,
+		Tags:    serviceData.Tags,
+		Meta:    serviceData.Meta,
+
+		EnableTagOverride: serviceData.EnableTagOverride,
+	}
+	if !serviceData.Check.empty() {
+		serviceRegData.Check = newServiceCheck(serviceData.Check)
 	}
-	return b.client.Agent().ServiceRegister(serviceRegData)
+	if serviceData.Weights != nil {
+		serviceRegData.Weights = &api.AgentWeights{
+			Passing: serviceData.Weights.Passing,
+			Warning: serviceData.Weights.Warning,
+		}
+	}
+	for _, check := range serviceData.Checks {
+		serviceRegData.Checks = append(serviceRegData.Checks, newServiceCheck(check))
+	}
+	for tag, address := range map[string]*TaggedAddress{"lan": serviceData.LAN, "wan": serviceData.WAN} {
+		if address == nil {
+			continue
+		}
+		if serviceRegData.TaggedAddresses == nil {
+			serviceRegData.TaggedAddresses = make(map[string]api.ServiceAddress)
+		}
+		port := address.Port
+		if port == 0 {
+			port = serviceData.Port
+		}
+		serviceRegData.TaggedAddresses[tag] = api.ServiceAddress{Address: address.Address, Port: port}
+	}
+	if serviceData.Proxy != nil {
+		serviceRegData.Kind = api.ServiceKindConnectProxy
+		serviceRegData.Proxy = newProxyConfig(serviceData.Proxy)
+	}
+	if serviceData.Connect != nil {
+		serviceRegData.Connect = newServiceConnect(serviceData.Connect)
+	}
+
+	return serviceRegData
 }
 
-// Deregister - deregisters a service
-func (b *broker) Deregister(serviceID string) error {
-	return b.client.Agent().ServiceDeregister(serviceID)
+func newServiceCheck(check CheckOptions) *api.AgentServiceCheck {
+	return &api.AgentServiceCheck{
+		CheckID:  check.ID,
+		Name:     check.Name,
+		HTTP:     check.HTTP,
+		TCP:      check.TCP,
+		Args:     check.Args,
+		Interval: check.Interval,
+		Timeout:  check.Timeout,
+		TTL:      check.TTL,
+		Status:   check.Status,
+
+		GRPC:              check.GRPC,
+		GRPCUseTLS:        check.GRPCUseTLS,
+		DockerContainerID: check.DockerContainerID,
+		Shell:             check.Shell,
+
+		AliasService: check.AliasService,
+		AliasNode:    check.AliasNode,
+
+		DeregisterCriticalServiceAfter: check.DeregisterCriticalServiceAfter,
+	}
+}
+
+// ValidateService - checks the service checks the way Register does before sending them: initial status,
+// TTL of at least minTTL, timeout within interval and no duplicate check IDs
+func ValidateService(serviceData Service, minTTL time.Duration) error {
+	if err := validateCheck(serviceData.Check, minTTL); err != nil {
+		return fmt.Errorf("invalid check of service %s: %v", serviceData.ID, err)
+	}
+	for _, check := range serviceData.Checks {
+		if err := validateCheck(check, minTTL); err != nil {
+			return fmt.Errorf("invalid check %s of service %s: %v", check.ID, serviceData.ID, err)
+		}
+	}
+	if _, err := assignCheckIDs(serviceData); err != nil {
+		return fmt.Errorf("invalid checks of service %s: %v", serviceData.ID, err)
+	}
+
+	return nil
+}
+
+// assignCheckIDs - gives checks of a multi-check service explicit IDs: service:<id> for Check, so TTL updates
+// keep working, and service:<id>:<n> for Checks. Duplicates are rejected since the agent silently overwrites them.
+func assignCheckIDs(serviceData Service) (Service, error) {
+	if len(serviceData.Checks) == 0 {
+		return serviceData, nil
+	}
+
+	serviceID := serviceData.ID
+	if serviceID == "" {
+		serviceID = serviceData.Name
+	}
+
+	seen := make(map[string]struct{})
+	if !serviceData.Check.empty() {
+		if serviceData.Check.ID == "" {
+			serviceData.Check.ID = "service:" + serviceID
+		}
+		seen[serviceData.Check.ID] = struct{}{}
+	}
+
+	checks := make([]CheckOptions, len(serviceData.Checks))
+	for i, check := range serviceData.Checks {
+		if check.ID == "" {
+			check.ID = fmt.Sprintf("service:%s:%d", serviceID, i+1)
+		}
+		if _, ok := seen[check.ID]; ok {
+			return serviceData, fmt.Errorf("duplicate check ID %s", check.ID)
+		}
+		seen[check.ID] = struct{}{}
+		checks[i] = check
+	}
+	serviceData.Checks = checks
+
+	return serviceData, nil
+}
+
+// empty - reports whether no check type is set
+func (c CheckOptions) empty() bool {
+	return !c.polling() && c.TTL == "" && c.AliasService == "" && c.AliasNode == ""
+}
+
+// polling - reports whether the agent runs the check every interval
+func (c CheckOptions) polling() bool {
+	return c.HTTP != "" || c.TCP != "" || c.GRPC != "" || len(c.Args) > 0 || c.DockerContainerID != ""
+}
+
+func newProxyConfig(proxy *ProxyOptions) *api.AgentServiceConnectProxyConfig {
+	return &api.AgentServiceConnectProxyConfig{
+		DestinationServiceName: proxy.DestinationServiceName,
+		DestinationServiceID:   proxy.DestinationServiceID,
+		LocalServiceAddress:    proxy.LocalServiceAddress,
+		LocalServicePort:       proxy.LocalServicePort,
+		Config:                 proxy.Config,
+	}
 }
 
-func (b *broker) SendHealthCheck(serviceID string, error string) error {
-	if error == "" {
-		if agentErr := b.client.Agent().PassTTL("service:"+serviceID, "ok"); agentErr != nil {
-			return agentErr
+func newServiceConnect(connect *ConnectOptions) *api.AgentServiceConnect {
+	serviceConnect := &api.AgentServiceConnect{Native: connect.Native}
+	if sidecar := connect.SidecarService; sidecar != nil {
+		proxy := &api.AgentServiceConnectProxyConfig{Config: sidecar.Config}
+		for _, upstream := range sidecar.Upstreams {
+			proxy.Upstreams = append(proxy.Upstreams, api.Upstream{
+				DestinationType: api.UpstreamDestTypeService,
+				DestinationName: upstream.DestinationName,
+				Datacenter:      upstream.Datacenter,
+				LocalBindPort:   upstream.LocalBindPort,
+			})
 		}
+		serviceConnect.SidecarService = &api.AgentServiceRegistration{
+			Port:  sidecar.Port,
+			Tags:  sidecar.Tags,
+			Proxy: proxy,
+		}
+	}
+	return serviceConnect
+}
+
+// register - sends registration to the agent with the token and caches both on success
+func (b *broker) register(serviceRegData *api.AgentServiceRegistration, token string) error {
+	if b.debugLogger != nil {
+		payload, _ := json.Marshal(serviceRegData)
+		b.debugLogger.Printf("consul register request: %s", payload)
+	}
+
+	err := b.retry(serviceRegData.ID, func() error {
+		return b.circuit.call(func() error {
+			return b.eachAgent(func(agent *api.Agent) error {
+				return agent.ServiceRegisterOpts(serviceRegData, api.ServiceRegisterOpts{Token: token})
+			})
+		})
+	})
+	b.debugResponse("register", serviceRegData.ID, err)
+	if err != nil {
+		return err
+	}
+
+	b.remember(serviceRegData, token)
+	return nil
+}
+
+// eachAgent - runs call on the primary and additional agents, it fails only when all of them failed
+// and logs failures of the rest
+func (b *broker) eachAgent(call func(agent *api.Agent) error) error {
+	_, err := b.eachAgentFailed(call)
+	return err
+}
+
+// eachAgentFailed - runs call like eachAgent and also returns errors of the agents that failed while others succeeded
+func (b *broker) eachAgentFailed(call func(agent *api.Agent) error) (map[*api.Agent]error, error) {
+	if len(b.agents) == 0 {
+		return nil, call(b.client.Agent())
+	}
+
+	clients := append([]*api.Client{b.client}, b.agents...)
+	errs := make([]error, 0)
+	failed := make(map[*api.Agent]error)
+	for i, client := range clients {
+		agent := client.Agent()
+		if err := call(agent); err != nil {
+			errs = append(errs, fmt.Errorf("consul agent %d: %v", i, err))
+			failed[agent] = err
+		}
+	}
+
+	if len(errs) == len(clients) {
+		return nil, joinErrors(errs...)
+	}
+	if len(errs) > 0 {
+		log.Printf("consul agents failed, others succeeded: %v", joinErrors(errs...))
+	}
+	return failed, nil
+}
+
+func (b *broker) remember(serviceRegData *api.AgentServiceRegistration, token string) {
+	b.Lock()
+	defer b.Unlock()
+
+	if token != "" {
+		b.tokens[serviceRegData.ID] = token
+	} else {
+		delete(b.tokens, serviceRegData.ID)
+	}
+
+	for i, service := range b.services {
+		if service.ID == serviceRegData.ID {
+			b.services[i] = serviceRegData
+			return
+		}
+	}
+	b.services = append(b.services, serviceRegData)
+}
+
+func (b *broker) forget(serviceID string) {
+	b.Lock()
+	defer b.Unlock()
+
+	delete(b.tokens, serviceID)
+	b.forgetTTL(serviceID)
+
+	for i, service := range b.services {
+		if service.ID == serviceID {
+			b.services = append(b.services[:i], b.services[i+1:]...)
+			return
+		}
+	}
+}
+
+// queryOptions - returns options with the token the service was registered with and the broker datacenter
+func (b *broker) queryOptions(serviceID string) *api.QueryOptions {
+	b.Lock()
+	defer b.Unlock()
+
+	return &api.QueryOptions{Token: b.tokens[serviceID], Datacenter: b.datacenter}
+}
+
+// reregistration - returns a copy of the cached registration to send again, TTL checks carry the status
+// last sent instead of the initial one, so e.g. a service past warmup does not go back to warning
+func (b *broker) reregistration(serviceID string) *api.AgentServiceRegistration {
+	serviceRegData := b.registration(serviceID)
+	if serviceRegData == nil {
 		return nil
 	}
 
-	if agentErr := b.client.Agent().FailTTL("service:"+serviceID, error); agentErr != nil {
-		return agentErr
+	b.Lock()
+	defer b.Unlock()
+
+	withStatus := func(check *api.AgentServiceCheck) *api.AgentServiceCheck {
+		changed := *check
+		for checkID, status := range b.ttlStatuses {
+			if matchesCheck(serviceRegData, check, checkID) {
+				changed.Status = status
+			}
+		}
+		return &changed
+	}
+	if serviceRegData.Check != nil {
+		serviceRegData.Check = withStatus(serviceRegData.Check)
+	}
+	if serviceRegData.Checks != nil {
+		checks := make(api.AgentServiceChecks, len(serviceRegData.Checks))
+		for i, check := range serviceRegData.Checks {
+			checks[i] = withStatus(check)
+		}
+		serviceRegData.Checks = checks
 	}
 
+	return serviceRegData
+}
+
+// registration - returns a copy of the cached registration or nil if the service was not registered by the broker
+func (b *broker) registration(serviceID string) *api.AgentServiceRegistration {
+	b.Lock()
+	defer b.Unlock()
+
+	for _, service := range b.services {
+		if service.ID == serviceID {
+			serviceRegData := *service
+			return &serviceRegData
+		}
+	}
 	return nil
 }
+
+// withDefaults - fills empty check settings from the broker check defaults
+func (b *broker) withDefaults(check CheckOptions) CheckOptions {
+	polling := check.polling()
+	if polling && check.Interval == "" && b.checkDefaults.Interval > 0 {
+		check.Interval = b.checkDefaults.Interval.String()
+	}
+	if polling && check.Timeout == "" && b.checkDefaults.Timeout > 0 {
+		check.Timeout = b.checkDefaults.Timeout.String()
+	}
+	if check.empty() && b.checkDefaults.TTL > 0 {
+		check.TTL = b.checkDefaults.TTL.String()
+	}
+
+	return check
+}
+
+// validateCheck - checks initial status, that TTL is at least minTTL and timeout is positive and does not exceed interval,
+// otherwise checks flap
+func validateCheck(check CheckOptions, minTTL time.Duration) error {
+	switch check.Status {
+	case "", api.HealthPassing, api.HealthWarning, api.HealthCritical:
+	default:
+		return fmt.Errorf("unknown initial status %q", check.Status)
+	}
+
+	if check.TTL != "" {
+		ttl, err := time.ParseDuration(check.TTL)
+		if err != nil {
+			return fmt.Errorf("can't parse ttl %q: %v", check.TTL, err)
+		}
+		if ttl < minTTL {
+			return fmt.Errorf("ttl %s is less than minimum %s", ttl, minTTL)
+		}
+	}
+
+	if check.Timeout == "" {
+		return nil
+	}
+
+	timeout, err := time.ParseDuration(check.Timeout)
+	if err != nil {
+		return fmt.Errorf("can't parse timeout %q: %v", check.Timeout, err)
+	}
+	if timeout <= 0 {
+		return fmt.Errorf("timeout %s must be positive", timeout)
+	}
+
+	if check.Interval == "" {
+		return nil
+	}
+	interval, err := time.ParseDuration(check.Interval)
+	if err != nil {
+		return fmt.Errorf("can't parse interval %q: %v", check.Interval, err)
+	}
+	if timeout > interval {
+		return fmt.Errorf("timeout %s exceeds interval %s", timeout, interval)
+	}
+
+	return nil
+}
+
+// UpdateMeta - merges meta into the registration made by this broker and re-registers it keeping checks and their last TTL statuses
+func (b *broker) UpdateMeta(serviceID string, meta map[string]string) error {
+	serviceRegData := b.reregistration(serviceID)
+	if serviceRegData == nil {
+		return fmt.Errorf("service %s is not registered by this broker", serviceID)
+	}
+
+	merged := make(map[string]string, len(serviceRegData.Meta)+len(meta))
+	for key, value := range serviceRegData.Meta {
+		merged[key] = value
+	}
+	for key, value := range meta {
+		merged[key] = value
+	}
+	serviceRegData.Meta = merged
+
+	return b.register(serviceRegData, b.queryOptions(serviceID).Token)
+}
+
+// SetCheckInterval - re-registers the service of the polling check with only the check interval changed,
+// so busy services can be checked less often and quiet ones more often
+func (b *broker) SetCheckInterval(checkID string, interval time.Duration) error {
+	if interval <= 0 {
+		return fmt.Errorf("interval %s of check %s must be positive", interval, checkID)
+	}
+
+	serviceRegData := b.reregistration(b.checkService(checkID))
+	if serviceRegData == nil {
+		return fmt.Errorf("check %s is not registered by this broker", checkID)
+	}
+
+	setInterval := func(check *api.AgentServiceCheck) (*api.AgentServiceCheck, error) {
+		if check == nil || !matchesCheck(serviceRegData, check, checkID) {
+			return check, nil
+		}
+		if check.Interval == "" {
+			return nil, fmt.Errorf("check %s is not a polling check", checkID)
+		}
+		if timeout, err := time.ParseDuration(check.Timeout); err == nil && timeout > interval {
+			return nil, fmt.Errorf("interval %s of check %s is shorter than its timeout %s", interval, checkID, timeout)
+		}
+
+		changed := *check
+		changed.Interval = interval.String()
+		return &changed, nil
+	}
+
+	var err error
+	if serviceRegData.Check, err = setInterval(serviceRegData.Check); err != nil {
+		return err
+	}
+	checks := make(api.AgentServiceChecks, len(serviceRegData.Checks))
+	for i, check := range serviceRegData.Checks {
+		if checks[i], err = setInterval(check); err != nil {
+			return err
+		}
+	}
+	serviceRegData.Checks = checks
+
+	return b.register(serviceRegData, b.queryOptions(serviceRegData.ID).Token)
+}
+
+// checkService - returns ID of the cached service owning the check, empty when there is none
+func (b *broker) checkService(checkID string) string {
+	b.Lock()
+	defer b.Unlock()
+
+	for _, service := range b.services {
+		for _, check := range append(api.AgentServiceChecks{service.Check}, service.Checks...) {
+			if check != nil && matchesCheck(service, check, checkID) {
+				return service.ID
+			}
+		}
+	}
+	return ""
+}
+
+// matchesCheck - reports whether check of the service has checkID, a check without ID is service:<id>
+func matchesCheck(service *api.AgentServiceRegistration, check *api.AgentServiceCheck, checkID string) bool {
+	return check.CheckID == checkID || check.CheckID == "" && "service:"+service.ID == checkID
+}
+
+// Deregister - deregisters a service
+func (b *broker) Deregister(serviceID string) error {
+	if b.debugLogger != nil {
+		b.debugLogger.Printf("consul deregister request: %s", serviceID)
+	}
+
+	err := b.circuit.call(func() error {
+		return b.eachAgent(func(agent *api.Agent) error {
+			return agent.ServiceDeregisterOpts(serviceID, b.queryOptions(serviceID))
+		})
+	})
+	b.debugResponse("deregister", serviceID, err)
+	if err != nil {
+		return err
+	}
+
+	b.forget(serviceID)
+	return nil
+}
+
+// DeregisterWithOpts - deregisters a service with the token and datacenter, e.g. admin token of cleanup tooling
+func (b *broker) DeregisterWithOpts(serviceID string, token, datacenter string) error {
+	if b.debugLogger != nil {
+		b.debugLogger.Printf("consul deregister request: %s in datacenter %q", serviceID, datacenter)
+	}
+
+	err := b.circuit.call(func() error {
+		return b.eachAgent(func(agent *api.Agent) error {
+			return agent.ServiceDeregisterOpts(serviceID, &api.QueryOptions{Token: token, Datacenter: datacenter})
+		})
+	})
+	b.debugResponse("deregister", serviceID, err)
+	if err != nil {
+		return err
+	}
+
+	b.forget(serviceID)
+	return nil
+}
+
+// RunUntil - blocks until ctx is cancelled and then deregisters all services registered by the broker,
+// so consul cleanup follows context driven shutdown
+func (b *broker) RunUntil(ctx context.Context) error {
+	<-ctx.Done()
+
+	b.Lock()
+	serviceIDs := make([]string, 0, len(b.services))
+	for _, service := range b.services {
+		serviceIDs = append(serviceIDs, service.ID)
+	}
+	b.Unlock()
+
+	errs := make([]error, 0, len(serviceIDs))
+	for _, serviceID := range serviceIDs {
+		if err := b.Deregister(serviceID); err != nil {
+			errs = append(errs, fmt.Errorf("do not deregister consul service %s, got error %v", serviceID, err))
+		}
+	}
+
+	return joinErrors(errs...)
+}
+
+func (b *broker) debugResponse(operation, serviceID string, err error) {
+	if b.debugLogger == nil {
+		return
+	}
+	if err != nil {
+		b.debugLogger.Printf("consul %s response for %s: %v", operation, serviceID, err)
+		return
+	}
+	b.debugLogger.Printf("consul %s response for %s: ok", operation, serviceID)
+}
+
+func (b *broker) SendHealthCheck(serviceID string, checkError string) error {
+	if checkError == "" {
+		return b.updateTTL(serviceID, "ok", api.HealthPassing)
+	}
+	return b.updateTTL(serviceID, checkError, api.HealthCritical)
+}
+
+// updateTTL - updates TTL check of the service, with WithAgentRecovery a check lost by the agent
+// is registered again from the cached registration
+func (b *broker) updateTTL(serviceID, output, status string) error {
+	var failed map[*api.Agent]error
+	update := func() error {
+		return b.circuit.call(func() error {
+			var err error
+			failed, err = b.eachAgentFailed(func(agent *api.Agent) error {
+				return agent.UpdateTTLOpts("service:"+serviceID, output, status, b.queryOptions(serviceID))
+			})
+			return err
+		})
+	}
+
+	err := b.retry(serviceID, update)
+	if b.recovery != nil && isMissingTTL(err) {
+		if err = b.reregister(serviceID); err == nil {
+			err = b.retry(serviceID, update)
+		}
+	}
+	if err == nil && b.recovery != nil {
+		for agent, agentErr := range failed {
+			if !isMissingTTL(agentErr) {
+				continue
+			}
+			if err := b.reregisterOn(agent, serviceID, output, status); err != nil {
+				log.Printf("can not recover service %s on consul agent: %v", serviceID, err)
+			}
+		}
+	}
+	if err == nil {
+		b.touchTTL("service:"+serviceID, status)
+	}
+
+	return err
+}
+
+// PruneCriticalServices - deregisters services whose checks have been critical for longer than olderThan
+// and returns the number of removed services. The agent does not report when a check became critical,
+// so the duration is counted from the first call that observed it critical: run it periodically, the first or
+// a one-shot run with positive olderThan removes nothing. Services are deregistered with their tokens.
+func (b *broker) PruneCriticalServices(olderThan time.Duration) (int, error) {
+	checks, err := b.client.Agent().ChecksWithFilter(fmt.Sprintf("Status == %q", api.HealthCritical))
+	if err != nil {
+		return 0, err
+	}
+
+	b.Lock()
+	now := time.Now()
+	critical := make(map[string]struct{})
+	expired := make([]string, 0)
+	for _, check := range checks {
+		if check.ServiceID == "" {
+			continue
+		}
+		if _, ok := critical[check.ServiceID]; ok {
+			continue
+		}
+		critical[check.ServiceID] = struct{}{}
+
+		since, ok := b.criticalSince[check.ServiceID]
+		if !ok {
+			since = now
+			b.criticalSince[check.ServiceID] = now
+		}
+		if now.Sub(since) >= olderThan {
+			expired = append(expired, check.ServiceID)
+		}
+	}
+
+	for serviceID := range b.criticalSince {
+		if _, ok := critical[serviceID]; !ok {
+			delete(b.criticalSince, serviceID)
+		}
+	}
+	b.Unlock()
+
+	removed := 0
+	for _, serviceID := range expired {
+		if err := b.client.Agent().ServiceDeregisterOpts(serviceID, b.queryOptions(serviceID)); err != nil {
+			return removed, fmt.Errorf("do not deregister critical service %s, got error %v", serviceID, err)
+		}
+		b.Lock()
+		delete(b.criticalSince, serviceID)
+		b.Unlock()
+		b.forget(serviceID)
+		removed++
+	}
+
+	return removed, nil
+}
+
+// LocalServices - returns services of the local agent matching the filter expression, empty filter matches all
+func (b *broker) LocalServices(filter string) ([]Service, error) {
+	agentServices, err := b.client.Agent().ServicesWithFilter(filter)
+	if err != nil {
+		return nil, err
+	}
+
+	services := make([]Service, 0, len(agentServices))
+	for _, agentService := range agentServices {
+		services = append(services, Service{
+			Name:    agentService.Service,
+			ID:      agentService.ID,
+			Address: agentService.Address,
+			Port:    agentService.Port,
+			Tags:    agentService.Tags,
+			Meta:    agentService.Meta,
+
+			EnableTagOverride: agentService.EnableTagOverride,
+		})
+	}
+	sort.Slice(services, func(i, j int) bool {
+		return services[i].ID < services[j].ID
+	})
+
+	return services, nil
+}
+
+// LocalHealth - returns statuses of the local agent checks matching the filter expression by check ID
+func (b *broker) LocalHealth(filter string) (map[string]string, error) {
+	checks, err := b.client.Agent().ChecksWithFilter(filter)
+	if err != nil {
+		return nil, err
+	}
+
+	statuses := make(map[string]string, len(checks))
+	for checkID, check := range checks {
+		statuses[checkID] = check.Status
+	}
+
+	return statuses, nil
+}
+
+// SendWarning - sets TTL check of the service to warning with the note
+func (b *broker) SendWarning(serviceID string, note string) error {
+	return b.updateTTL(serviceID, note, api.HealthWarning)
+}
+
+// SetMaintenance - toggles maintenance mode of the service, enabled mode adds a critical check with the reason
+func (b *broker) SetMaintenance(serviceID string, enable bool, reason string) error {
+	return b.circuit.call(func() error {
+		return b.eachAgent(func(agent *api.Agent) error {
+			if enable {
+				return agent.EnableServiceMaintenanceOpts(serviceID, reason, b.queryOptions(serviceID))
+			}
+			return agent.DisableServiceMaintenanceOpts(serviceID, b.queryOptions(serviceID))
+		})
+	})
+}
+
+// Datacenters - returns all datacenters known to consul
+func (b *broker) Datacenters() ([]string, error) {
+	return b.client.Catalog().Datacenters()
+}
+
+// localDatacenter - returns datacenter of the broker, of the local agent when the broker has none
+func (b *broker) localDatacenter() (string, error) {
+	if b.datacenter != "" {
+		return b.datacenter, nil
+	}
+
+	self, err := b.client.Agent().Self()
+	if err != nil {
+		return "", err
+	}
+
+	datacenter, ok := self["Config"]["Datacenter"].(string)
+	if !ok {
+		return "", fmt.Errorf("agent self info has no Config.Datacenter")
+	}
+	return datacenter, nil
+}
+
+// IsServerAgent - reports whether the local agent runs in server mode
+func (b *broker) IsServerAgent() (bool, error) {
+	self, err := b.client.Agent().Self()
+	if err != nil {
+		return false, err
+	}
+
+	server, ok := self["Config"]["Server"].(bool)
+	if !ok {
+		return false, fmt.Errorf("agent self info has no Config.Server flag")
+	}
+	return server, nil
+}
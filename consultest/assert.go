@@ -0,0 +1,45 @@
+package consultest
+
+// TestingT - subset of testing.TB used by assertions, so the package does not depend on testing
+type TestingT interface {
+	Helper()
+	Errorf(format string, args ...interface{})
+}
+
+// AssertRegistered - fails t unless the service is registered
+func (f *Broker) AssertRegistered(t TestingT, serviceID string) bool {
+	t.Helper()
+
+	if _, ok := f.Service(serviceID); !ok {
+		t.Errorf("service %q is not registered", serviceID)
+		return false
+	}
+	return true
+}
+
+// AssertDeregistered - fails t unless the service was registered and then deregistered
+func (f *Broker) AssertDeregistered(t TestingT, serviceID string) bool {
+	t.Helper()
+
+	f.Lock()
+	_, registered := f.services[serviceID]
+	deregistered := f.deregistered[serviceID]
+	f.Unlock()
+
+	if registered || !deregistered {
+		t.Errorf("service %q is not deregistered", serviceID)
+		return false
+	}
+	return true
+}
+
+// AssertCheckStatus - fails t unless the check, or the service:<id> check of a service ID, has the status
+func (f *Broker) AssertCheckStatus(t TestingT, id, status string) bool {
+	t.Helper()
+
+	if actual := f.CheckStatus(id); actual != status {
+		t.Errorf("check %q has status %q, expected %q", id, actual, status)
+		return false
+	}
+	return true
+}
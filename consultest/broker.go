@@ -0,0 +1,1061 @@
+// Package consultest provides in-memory consul.Broker, so code using the broker or wrapper
+// can be tested without a consul agent, wrappers over it need consul.WithConsulEnabled(true). ResolveService, NewLock and ConnectTLSConfig always fail:
+// InstancePicker and Lock can only be built by the consul package and TLS material needs the agent CA,
+// code using them needs a consul dev agent.
+package consultest
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"fmt"
+	"github.com/fakofsky/consul"
+	"github.com/hashicorp/consul/api"
+	"io/ioutil"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	defaultDatacenter = "dc1"
+	// nodeAddress - address of instances registered without one, as the agent node address
+	nodeAddress = "127.0.0.1"
+)
+
+// Call - broker method call recorded by Broker
+type Call struct {
+	Method string
+	Args   []interface{}
+}
+
+// Check - state of a check kept by Broker
+type Check struct {
+	ID        string
+	ServiceID string
+	Status    string
+	Output    string
+	TTL       time.Duration
+	Interval  time.Duration
+	Updated   time.Time
+}
+
+type userEvent struct {
+	name    string
+	payload []byte
+}
+
+// Broker - in-memory consul.Broker keeping services, checks, KV, events, config entries and intentions.
+// Services are validated with consul.ValidateService. Every call is recorded and can be failed with Fail.
+// Filters of LocalServices and LocalHealth are ignored, ResolveService, NewLock and ConnectTLSConfig are not supported.
+type Broker struct {
+	// Datacenter is the local datacenter, dc1 when empty
+	Datacenter string
+	// MinTTL is the minimum TTL of checks, consul.DefaultMinTTL when empty
+	MinTTL time.Duration
+
+	services      map[string]consul.Service
+	checks        map[string]*Check
+	maintenance   map[string]string
+	deregistered  map[string]bool
+	criticalSince map[string]time.Time
+	kv            map[string][]byte
+	events        []userEvent
+	configEntries map[string]api.ConfigEntry
+	intentions    map[string]map[string]bool
+	failures      map[string]error
+	calls         []Call
+	next          map[string]int
+	changed       chan struct{}
+	sync.Mutex
+}
+
+var _ consul.Broker = (*Broker)(nil)
+
+// NewBroker - returns empty in-memory broker
+func NewBroker() *Broker {
+	return &Broker{
+		services:      make(map[string]consul.Service),
+		checks:        make(map[string]*Check),
+		maintenance:   make(map[string]string),
+		deregistered:  make(map[string]bool),
+		criticalSince: make(map[string]time.Time),
+		kv:            make(map[string][]byte),
+		configEntries: make(map[string]api.ConfigEntry),
+		intentions:    make(map[string]map[string]bool),
+		failures:      make(map[string]error),
+		next:          make(map[string]int),
+		changed:       make(chan struct{}),
+	}
+}
+
+// Fail - makes every call of the method return err until Fail is called with nil err
+func (f *Broker) Fail(method string, err error) {
+	f.Lock()
+	defer f.Unlock()
+
+	if err == nil {
+		delete(f.failures, method)
+		return
+	}
+	f.failures[method] = err
+}
+
+// Calls - returns recorded calls in order
+func (f *Broker) Calls() []Call {
+	f.Lock()
+	defer f.Unlock()
+
+	return append([]Call{}, f.calls...)
+}
+
+// CallCount - returns number of recorded calls of the method
+func (f *Broker) CallCount(method string) int {
+	f.Lock()
+	defer f.Unlock()
+
+	count := 0
+	for _, call := range f.calls {
+		if call.Method == method {
+			count++
+		}
+	}
+	return count
+}
+
+// Service - returns registered service
+func (f *Broker) Service(serviceID string) (consul.Service, bool) {
+	f.Lock()
+	defer f.Unlock()
+
+	service, ok := f.services[serviceID]
+	return service, ok
+}
+
+// CheckStatus - returns status of the check, of the service:<id> check when id is a service ID,
+// empty when there is no such check
+func (f *Broker) CheckStatus(id string) string {
+	f.Lock()
+	defer f.Unlock()
+
+	if check := f.check(id); check != nil {
+		return check.Status
+	}
+	return ""
+}
+
+// SetCheckStatus - sets status of the check as the agent running HTTP, TCP or script check would
+func (f *Broker) SetCheckStatus(checkID, status, output string) error {
+	f.Lock()
+	defer f.Unlock()
+
+	check := f.check(checkID)
+	if check == nil {
+		return fmt.Errorf("unknown check ID %q", checkID)
+	}
+	f.update(check, status, output)
+	return nil
+}
+
+// record - records the call and returns failure injected by Fail
+func (f *Broker) record(method string, args ...interface{}) error {
+	f.Lock()
+	defer f.Unlock()
+
+	f.calls = append(f.calls, Call{Method: method, Args: args})
+	return f.failures[method]
+}
+
+// notify - wakes watches up, f must be locked
+func (f *Broker) notify() {
+	close(f.changed)
+	f.changed = make(chan struct{})
+}
+
+// check - returns check by ID or the service:<id> check of a service ID, f must be locked
+func (f *Broker) check(id string) *Check {
+	if check, ok := f.checks[id]; ok {
+		return check
+	}
+	return f.checks["service:"+id]
+}
+
+// update - sets check status and output, f must be locked
+func (f *Broker) update(check *Check, status, output string) {
+	check.Status = status
+	check.Output = output
+	check.Updated = time.Now()
+	f.notify()
+}
+
+func (f *Broker) Register(serviceData consul.Service) error {
+	if err := f.record("Register", serviceData); err != nil {
+		return err
+	}
+
+	if err := f.validate(serviceData); err != nil {
+		return err
+	}
+
+	f.Lock()
+	defer f.Unlock()
+
+	f.register(serviceData)
+	return nil
+}
+
+// validate - rejects services the consul broker does not register
+func (f *Broker) validate(serviceData consul.Service) error {
+	minTTL := f.MinTTL
+	if minTTL == 0 {
+		minTTL = consul.DefaultMinTTL
+	}
+	return consul.ValidateService(serviceData, minTTL)
+}
+
+// register - stores the service replacing its checks, f must be locked
+func (f *Broker) register(serviceData consul.Service) {
+	if serviceData.ID == "" {
+		serviceData.ID = serviceData.Name
+	}
+	f.services[serviceData.ID] = serviceData
+	delete(f.deregistered, serviceData.ID)
+
+	for checkID, check := range f.checks {
+		if check.ServiceID == serviceData.ID {
+			delete(f.checks, checkID)
+		}
+	}
+	if isCheck(serviceData.Check) {
+		checkID := serviceData.Check.ID
+		if checkID == "" {
+			checkID = "service:" + serviceData.ID
+		}
+		f.checks[checkID] = newCheck(checkID, serviceData.ID, serviceData.Check)
+	}
+	for i, checkOptions := range serviceData.Checks {
+		checkID := checkOptions.ID
+		if checkID == "" {
+			checkID = fmt.Sprintf("service:%s:%d", serviceData.ID, i+1)
+		}
+		f.checks[checkID] = newCheck(checkID, serviceData.ID, checkOptions)
+	}
+
+	f.notify()
+}
+
+func (f *Broker) RegisterWithResult(serviceData consul.Service) (*consul.RegisterResult, error) {
+	if err := f.record("RegisterWithResult", serviceData); err != nil {
+		return nil, err
+	}
+
+	if err := f.validate(serviceData); err != nil {
+		return nil, err
+	}
+
+	f.Lock()
+	defer f.Unlock()
+
+	f.register(serviceData)
+	serviceID := serviceData.ID
+	if serviceID == "" {
+		serviceID = serviceData.Name
+	}
+	return &consul.RegisterResult{ServiceID: serviceID}, nil
+}
+
+func (f *Broker) RegisterBatch(services []consul.Service, policy consul.BatchPolicy) error {
+	if err := f.record("RegisterBatch", services, policy); err != nil {
+		return err
+	}
+
+	var errs []string
+	registered := make([]string, 0, len(services))
+	for _, serviceData := range services {
+		serviceID := serviceData.ID
+		if serviceID == "" {
+			serviceID = serviceData.Name
+		}
+
+		_, existed := f.Service(serviceID)
+		err := f.Register(serviceData)
+		if err == nil {
+			if !existed {
+				registered = append(registered, serviceID)
+			}
+			continue
+		}
+
+		errs = append(errs, fmt.Sprintf("can not register service %s in consul %v", serviceID, err))
+		if policy != consul.BatchAllOrNothing {
+			continue
+		}
+		for _, serviceID := range registered {
+			if err := f.Deregister(serviceID); err != nil {
+				errs = append(errs, fmt.Sprintf("do not roll back consul service %s, got error %v", serviceID, err))
+			}
+		}
+		break
+	}
+
+	if len(errs) > 0 {
+		return fmt.Errorf("%s", strings.Join(errs, "; "))
+	}
+	return nil
+}
+
+func (f *Broker) Deregister(serviceID string) error {
+	if err := f.record("Deregister", serviceID); err != nil {
+		return err
+	}
+
+	f.Lock()
+	defer f.Unlock()
+
+	return f.deregister(serviceID)
+}
+
+// deregister - removes the service with its checks, f must be locked
+func (f *Broker) deregister(serviceID string) error {
+	if _, ok := f.services[serviceID]; !ok {
+		return fmt.Errorf("unknown service ID %q", serviceID)
+	}
+
+	delete(f.services, serviceID)
+	delete(f.maintenance, serviceID)
+	delete(f.criticalSince, serviceID)
+	for checkID, check := range f.checks {
+		if check.ServiceID == serviceID {
+			delete(f.checks, checkID)
+		}
+	}
+	f.deregistered[serviceID] = true
+
+	f.notify()
+	return nil
+}
+
+func (f *Broker) DeregisterWithOpts(serviceID string, token, datacenter string) error {
+	if err := f.record("DeregisterWithOpts", serviceID, token, datacenter); err != nil {
+		return err
+	}
+
+	f.Lock()
+	defer f.Unlock()
+
+	return f.deregister(serviceID)
+}
+
+func (f *Broker) RunUntil(ctx context.Context) error {
+	if err := f.record("RunUntil"); err != nil {
+		return err
+	}
+	<-ctx.Done()
+
+	f.Lock()
+	defer f.Unlock()
+
+	for serviceID := range f.services {
+		f.deregister(serviceID)
+	}
+	return nil
+}
+
+func (f *Broker) SendHealthCheck(serviceID string, checkError string) error {
+	if err := f.record("SendHealthCheck", serviceID, checkError); err != nil {
+		return err
+	}
+
+	if checkError == "" {
+		return f.updateTTL("service:"+serviceID, api.HealthPassing, "ok")
+	}
+	return f.updateTTL("service:"+serviceID, api.HealthCritical, checkError)
+}
+
+func (f *Broker) SendWarning(serviceID string, note string) error {
+	if err := f.record("SendWarning", serviceID, note); err != nil {
+		return err
+	}
+
+	return f.updateTTL("service:"+serviceID, api.HealthWarning, note)
+}
+
+// updateTTL - updates TTL check, failing as the agent does for unknown checks
+func (f *Broker) updateTTL(checkID, status, output string) error {
+	f.Lock()
+	defer f.Unlock()
+
+	check, ok := f.checks[checkID]
+	if !ok || check.TTL == 0 {
+		return fmt.Errorf("CheckID %q does not have associated TTL", checkID)
+	}
+	f.update(check, status, output)
+	return nil
+}
+
+func (f *Broker) SetMaintenance(serviceID string, enable bool, reason string) error {
+	if err := f.record("SetMaintenance", serviceID, enable, reason); err != nil {
+		return err
+	}
+
+	f.Lock()
+	defer f.Unlock()
+
+	if _, ok := f.services[serviceID]; !ok {
+		return fmt.Errorf("unknown service ID %q", serviceID)
+	}
+	if enable {
+		f.maintenance[serviceID] = reason
+	} else {
+		delete(f.maintenance, serviceID)
+	}
+	f.notify()
+	return nil
+}
+
+func (f *Broker) TTLRemaining(checkID string) (time.Duration, error) {
+	if err := f.record("TTLRemaining", checkID); err != nil {
+		return 0, err
+	}
+
+	f.Lock()
+	defer f.Unlock()
+
+	check, ok := f.checks[checkID]
+	if !ok {
+		return 0, fmt.Errorf("check %s is not registered in the agent", checkID)
+	}
+	if check.TTL == 0 {
+		return 0, fmt.Errorf("check %s is not ttl check", checkID)
+	}
+	if check.Updated.IsZero() {
+		return 0, nil
+	}
+
+	if remaining := check.TTL - time.Since(check.Updated); remaining > 0 {
+		return remaining, nil
+	}
+	return 0, nil
+}
+
+func (f *Broker) RegisterCheck(check consul.CheckOptions) error {
+	if err := f.record("RegisterCheck", check); err != nil {
+		return err
+	}
+
+	checkID := check.ID
+	if checkID == "" {
+		checkID = check.Name
+	}
+	if checkID == "" {
+		return fmt.Errorf("check needs ID or Name")
+	}
+
+	f.Lock()
+	defer f.Unlock()
+
+	f.checks[checkID] = newCheck(checkID, "", check)
+	f.notify()
+	return nil
+}
+
+func (f *Broker) SendCheckHealth(checkID string, checkError string) error {
+	if err := f.record("SendCheckHealth", checkID, checkError); err != nil {
+		return err
+	}
+
+	if checkError == "" {
+		return f.updateTTL(checkID, api.HealthPassing, "ok")
+	}
+	return f.updateTTL(checkID, api.HealthCritical, checkError)
+}
+
+func (f *Broker) DeregisterCheck(checkID string) error {
+	if err := f.record("DeregisterCheck", checkID); err != nil {
+		return err
+	}
+
+	f.Lock()
+	defer f.Unlock()
+
+	if _, ok := f.checks[checkID]; !ok {
+		return fmt.Errorf("unknown check ID %q", checkID)
+	}
+	delete(f.checks, checkID)
+	f.notify()
+	return nil
+}
+
+func (f *Broker) UpdateMeta(serviceID string, meta map[string]string) error {
+	if err := f.record("UpdateMeta", serviceID, meta); err != nil {
+		return err
+	}
+
+	f.Lock()
+	defer f.Unlock()
+
+	service, ok := f.services[serviceID]
+	if !ok {
+		return fmt.Errorf("service %s is not registered by this broker", serviceID)
+	}
+	merged := make(map[string]string, len(service.Meta)+len(meta))
+	for key, value := range service.Meta {
+		merged[key] = value
+	}
+	for key, value := range meta {
+		merged[key] = value
+	}
+	service.Meta = merged
+	f.services[serviceID] = service
+
+	f.notify()
+	return nil
+}
+
+func (f *Broker) SetCheckInterval(checkID string, interval time.Duration) error {
+	if err := f.record("SetCheckInterval", checkID, interval); err != nil {
+		return err
+	}
+	if interval <= 0 {
+		return fmt.Errorf("interval %s of check %s must be positive", interval, checkID)
+	}
+
+	f.Lock()
+	defer f.Unlock()
+
+	check, ok := f.checks[checkID]
+	if !ok || check.ServiceID == "" {
+		return fmt.Errorf("check %s is not registered by this broker", checkID)
+	}
+	if check.Interval == 0 {
+		return fmt.Errorf("check %s is not a polling check", checkID)
+	}
+	check.Interval = interval
+
+	service := f.services[check.ServiceID]
+	if service.Check.ID == checkID || service.Check.ID == "" && "service:"+service.ID == checkID {
+		service.Check.Interval = interval.String()
+	}
+	checks := make([]consul.CheckOptions, len(service.Checks))
+	for i, checkOptions := range service.Checks {
+		if checkOptions.ID == checkID || checkOptions.ID == "" && fmt.Sprintf("service:%s:%d", service.ID, i+1) == checkID {
+			checkOptions.Interval = interval.String()
+		}
+		checks[i] = checkOptions
+	}
+	service.Checks = checks
+	f.services[service.ID] = service
+
+	return nil
+}
+
+func (f *Broker) ExportRegistrations(path string) error {
+	if err := f.record("ExportRegistrations", path); err != nil {
+		return err
+	}
+
+	f.Lock()
+	services := f.sortedServices()
+	f.Unlock()
+
+	payload, err := json.MarshalIndent(services, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := ioutil.WriteFile(path, payload, 0600); err != nil {
+		return fmt.Errorf("can not export registrations to %s, got error %v", path, err)
+	}
+	return nil
+}
+
+func (f *Broker) RegisterFromFile(path string) error {
+	if err := f.record("RegisterFromFile", path); err != nil {
+		return err
+	}
+
+	payload, err := ioutil.ReadFile(path)
+	if err != nil {
+		return fmt.Errorf("can not read registrations from %s, got error %v", path, err)
+	}
+	var services []consul.Service
+	if err := json.Unmarshal(payload, &services); err != nil {
+		return fmt.Errorf("can not parse registrations from %s, got error %v", path, err)
+	}
+
+	f.Lock()
+	defer f.Unlock()
+
+	for _, serviceData := range services {
+		f.register(serviceData)
+	}
+	return nil
+}
+
+func (f *Broker) SwapPrimary(key, fromID, toID string) error {
+	if err := f.record("SwapPrimary", key, fromID, toID); err != nil {
+		return err
+	}
+
+	f.Lock()
+	defer f.Unlock()
+
+	if _, ok := f.services[fromID]; fromID != "" && !ok {
+		return fmt.Errorf("service %s is not registered by this broker", fromID)
+	}
+	if _, ok := f.services[toID]; !ok {
+		return fmt.Errorf("service %s is not registered by this broker", toID)
+	}
+	if current := string(f.kv[key]); current != fromID {
+		return fmt.Errorf("primary record %s holds %q, expected %q", key, current, fromID)
+	}
+
+	f.kv[key] = []byte(toID)
+	if fromID != "" {
+		from := f.services[fromID]
+		from.Tags = withoutTag(from.Tags, consul.PrimaryTag)
+		f.services[fromID] = from
+	}
+	to := f.services[toID]
+	to.Tags = append(withoutTag(to.Tags, consul.PrimaryTag), consul.PrimaryTag)
+	f.services[toID] = to
+
+	f.notify()
+	return nil
+}
+
+func (f *Broker) UpsertIntention(source, destination string, allow bool) error {
+	if err := f.record("UpsertIntention", source, destination, allow); err != nil {
+		return err
+	}
+
+	f.Lock()
+	defer f.Unlock()
+
+	if f.intentions[destination] == nil {
+		f.intentions[destination] = make(map[string]bool)
+	}
+	f.intentions[destination][source] = allow
+	return nil
+}
+
+func (f *Broker) DeleteIntention(source, destination string) error {
+	if err := f.record("DeleteIntention", source, destination); err != nil {
+		return err
+	}
+
+	f.Lock()
+	defer f.Unlock()
+
+	delete(f.intentions[destination], source)
+	if len(f.intentions[destination]) == 0 {
+		delete(f.intentions, destination)
+	}
+	return nil
+}
+
+// Intention - returns whether source is allowed to connect destination and whether there is such intention
+func (f *Broker) Intention(source, destination string) (allow bool, ok bool) {
+	f.Lock()
+	defer f.Unlock()
+
+	allow, ok = f.intentions[destination][source]
+	return allow, ok
+}
+
+func (f *Broker) WriteConfigEntry(entry api.ConfigEntry) error {
+	if err := f.record("WriteConfigEntry", entry); err != nil {
+		return err
+	}
+	if entry == nil {
+		return fmt.Errorf("config entry is nil")
+	}
+
+	f.Lock()
+	defer f.Unlock()
+
+	f.configEntries[entry.GetKind()+"/"+entry.GetName()] = entry
+	return nil
+}
+
+func (f *Broker) DeleteConfigEntry(kind, name string) error {
+	if err := f.record("DeleteConfigEntry", kind, name); err != nil {
+		return err
+	}
+
+	f.Lock()
+	defer f.Unlock()
+
+	delete(f.configEntries, kind+"/"+name)
+	return nil
+}
+
+// ConfigEntry - returns config entry written by WriteConfigEntry
+func (f *Broker) ConfigEntry(kind, name string) (api.ConfigEntry, bool) {
+	f.Lock()
+	defer f.Unlock()
+
+	entry, ok := f.configEntries[kind+"/"+name]
+	return entry, ok
+}
+
+func (f *Broker) PruneCriticalServices(olderThan time.Duration) (int, error) {
+	if err := f.record("PruneCriticalServices", olderThan); err != nil {
+		return 0, err
+	}
+
+	f.Lock()
+	defer f.Unlock()
+
+	now := time.Now()
+	pruned := 0
+	for serviceID := range f.services {
+		if f.status(serviceID) != api.HealthCritical {
+			delete(f.criticalSince, serviceID)
+			continue
+		}
+		since, ok := f.criticalSince[serviceID]
+		if !ok {
+			f.criticalSince[serviceID] = now
+			since = now
+		}
+		if now.Sub(since) >= olderThan {
+			f.deregister(serviceID)
+			pruned++
+		}
+	}
+	return pruned, nil
+}
+
+func (f *Broker) Discover(serviceName string, onlyHealthy bool) ([]consul.ServiceInstance, error) {
+	if err := f.record("Discover", serviceName, onlyHealthy); err != nil {
+		return nil, err
+	}
+
+	f.Lock()
+	defer f.Unlock()
+
+	return f.instances(serviceName, "", onlyHealthy, false), nil
+}
+
+func (f *Broker) DiscoverInDatacenter(serviceName, datacenter string, onlyHealthy bool) ([]consul.ServiceInstance, error) {
+	if err := f.record("DiscoverInDatacenter", serviceName, datacenter, onlyHealthy); err != nil {
+		return nil, err
+	}
+
+	f.Lock()
+	defer f.Unlock()
+
+	wan := datacenter != "" && datacenter != f.datacenter()
+	return f.instances(serviceName, "", onlyHealthy, wan), nil
+}
+
+func (f *Broker) DiscoverByTag(serviceName, tag string, passingOnly bool) ([]consul.ServiceInstance, error) {
+	if err := f.record("DiscoverByTag", serviceName, tag, passingOnly); err != nil {
+		return nil, err
+	}
+
+	f.Lock()
+	defer f.Unlock()
+
+	return f.instances(serviceName, tag, passingOnly, false), nil
+}
+
+func (f *Broker) Resolve(serviceName string) (string, error) {
+	if err := f.record("Resolve", serviceName); err != nil {
+		return "", err
+	}
+
+	f.Lock()
+	defer f.Unlock()
+
+	instances := f.instances(serviceName, "", true, false)
+	if len(instances) == 0 {
+		return "", fmt.Errorf("service %s has no passing instances", serviceName)
+	}
+	next := f.next[serviceName] % len(instances)
+	f.next[serviceName] = next + 1
+
+	instance := instances[next]
+	return net.JoinHostPort(instance.Address, strconv.Itoa(instance.Port)), nil
+}
+
+func (f *Broker) ResolveService(name string) (*consul.InstancePicker, error) {
+	if err := f.record("ResolveService", name); err != nil {
+		return nil, err
+	}
+
+	return nil, fmt.Errorf("ResolveService is not supported by consultest broker, use Resolve")
+}
+
+func (f *Broker) ServiceHealthScore(serviceName string) (passing, warning, critical int, err error) {
+	if err := f.record("ServiceHealthScore", serviceName); err != nil {
+		return 0, 0, 0, err
+	}
+
+	f.Lock()
+	defer f.Unlock()
+
+	for serviceID, service := range f.services {
+		if service.Name != serviceName {
+			continue
+		}
+		switch f.status(serviceID) {
+		case api.HealthPassing:
+			passing++
+		case api.HealthWarning:
+			warning++
+		default:
+			critical++
+		}
+	}
+	return passing, warning, critical, nil
+}
+
+func (f *Broker) Datacenters() ([]string, error) {
+	if err := f.record("Datacenters"); err != nil {
+		return nil, err
+	}
+
+	return []string{f.datacenter()}, nil
+}
+
+func (f *Broker) IsServerAgent() (bool, error) {
+	if err := f.record("IsServerAgent"); err != nil {
+		return false, err
+	}
+
+	return false, nil
+}
+
+func (f *Broker) FireEvent(name string, payload []byte) error {
+	if err := f.record("FireEvent", name, payload); err != nil {
+		return err
+	}
+
+	f.Lock()
+	defer f.Unlock()
+
+	f.events = append(f.events, userEvent{name: name, payload: payload})
+	f.notify()
+	return nil
+}
+
+func (f *Broker) LocalServices(filter string) ([]consul.Service, error) {
+	if err := f.record("LocalServices", filter); err != nil {
+		return nil, err
+	}
+
+	f.Lock()
+	defer f.Unlock()
+
+	return f.sortedServices(), nil
+}
+
+func (f *Broker) LocalHealth(filter string) (map[string]string, error) {
+	if err := f.record("LocalHealth", filter); err != nil {
+		return nil, err
+	}
+
+	f.Lock()
+	defer f.Unlock()
+
+	health := make(map[string]string, len(f.checks))
+	for checkID, check := range f.checks {
+		health[checkID] = check.Status
+	}
+	return health, nil
+}
+
+func (f *Broker) KVGet(key string) ([]byte, error) {
+	if err := f.record("KVGet", key); err != nil {
+		return nil, err
+	}
+
+	f.Lock()
+	defer f.Unlock()
+
+	value, ok := f.kv[key]
+	if !ok {
+		return nil, consul.ErrKeyNotFound
+	}
+	return value, nil
+}
+
+func (f *Broker) KVPut(key string, value []byte) error {
+	if err := f.record("KVPut", key, value); err != nil {
+		return err
+	}
+
+	f.Lock()
+	defer f.Unlock()
+
+	if value == nil {
+		value = []byte{}
+	}
+	f.kv[key] = value
+	f.notify()
+	return nil
+}
+
+func (f *Broker) KVDelete(key string) error {
+	if err := f.record("KVDelete", key); err != nil {
+		return err
+	}
+
+	f.Lock()
+	defer f.Unlock()
+
+	delete(f.kv, key)
+	f.notify()
+	return nil
+}
+
+func (f *Broker) KVList(prefix string) (map[string][]byte, error) {
+	if err := f.record("KVList", prefix); err != nil {
+		return nil, err
+	}
+
+	f.Lock()
+	defer f.Unlock()
+
+	return f.kvList(prefix), nil
+}
+
+func (f *Broker) NewLock(key string, opts ...consul.LockOption) (*consul.Lock, error) {
+	if err := f.record("NewLock", key); err != nil {
+		return nil, err
+	}
+
+	return nil, fmt.Errorf("NewLock is not supported by consultest broker")
+}
+
+func (f *Broker) ConnectTLSConfig(ctx context.Context, serviceID string) (*tls.Config, error) {
+	if err := f.record("ConnectTLSConfig", serviceID); err != nil {
+		return nil, err
+	}
+
+	return nil, fmt.Errorf("ConnectTLSConfig is not supported by consultest broker")
+}
+
+// datacenter - returns the local datacenter
+func (f *Broker) datacenter() string {
+	if f.Datacenter == "" {
+		return defaultDatacenter
+	}
+	return f.Datacenter
+}
+
+// status - returns aggregated status of the service, maintenance is critical, f must be locked
+func (f *Broker) status(serviceID string) string {
+	if _, ok := f.maintenance[serviceID]; ok {
+		return api.HealthCritical
+	}
+
+	status := api.HealthPassing
+	for _, check := range f.checks {
+		if check.ServiceID != serviceID {
+			continue
+		}
+		switch check.Status {
+		case api.HealthCritical:
+			return api.HealthCritical
+		case api.HealthWarning:
+			status = api.HealthWarning
+		}
+	}
+	return status
+}
+
+// instances - returns instances of the service sorted by ID, f must be locked
+func (f *Broker) instances(serviceName, tag string, onlyHealthy, wan bool) []consul.ServiceInstance {
+	instances := make([]consul.ServiceInstance, 0)
+	for _, service := range f.sortedServices() {
+		if service.Name != serviceName || tag != "" && !hasTag(service.Tags, tag) {
+			continue
+		}
+		if onlyHealthy && f.status(service.ID) != api.HealthPassing {
+			continue
+		}
+
+		instance := consul.ServiceInstance{
+			ID:      service.ID,
+			Name:    service.Name,
+			Address: service.Address,
+			Port:    service.Port,
+			Tags:    service.Tags,
+			Meta:    service.Meta,
+		}
+		if instance.Address == "" {
+			instance.Address = nodeAddress
+		}
+		if wan && service.WAN != nil && service.WAN.Address != "" {
+			instance.Address = service.WAN.Address
+			if service.WAN.Port != 0 {
+				instance.Port = service.WAN.Port
+			}
+		}
+		instances = append(instances, instance)
+	}
+	return instances
+}
+
+// sortedServices - returns services sorted by ID, f must be locked
+func (f *Broker) sortedServices() []consul.Service {
+	services := make([]consul.Service, 0, len(f.services))
+	for _, service := range f.services {
+		services = append(services, service)
+	}
+	sort.Slice(services, func(i, j int) bool {
+		return services[i].ID < services[j].ID
+	})
+	return services
+}
+
+// kvList - returns copy of keys under the prefix, f must be locked
+func (f *Broker) kvList(prefix string) map[string][]byte {
+	values := make(map[string][]byte)
+	for key, value := range f.kv {
+		if strings.HasPrefix(key, prefix) {
+			values[key] = value
+		}
+	}
+	return values
+}
+
+// isCheck - reports whether any check type is set, as the broker omits empty checks
+func isCheck(check consul.CheckOptions) bool {
+	return check.HTTP != "" || check.TCP != "" || check.GRPC != "" || len(check.Args) > 0 ||
+		check.DockerContainerID != "" || check.TTL != "" || check.AliasService != "" || check.AliasNode != ""
+}
+
+func newCheck(checkID, serviceID string, options consul.CheckOptions) *Check {
+	check := &Check{ID: checkID, ServiceID: serviceID, Status: options.Status}
+	if check.Status == "" {
+		check.Status = api.HealthCritical
+	}
+	check.TTL, _ = time.ParseDuration(options.TTL)
+	check.Interval, _ = time.ParseDuration(options.Interval)
+	return check
+}
+
+func hasTag(tags []string, tag string) bool {
+	for _, t := range tags {
+		if t == tag {
+			return true
+		}
+	}
+	return false
+}
+
+func withoutTag(tags []string, tag string) []string {
+	kept := make([]string, 0, len(tags))
+	for _, t := range tags {
+		if t != tag {
+			kept = append(kept, t)
+		}
+	}
+	return kept
+}
@@ -0,0 +1,228 @@
+package consultest
+
+import (
+	"errors"
+	"fmt"
+	"github.com/fakofsky/consul"
+	"github.com/hashicorp/consul/api"
+	"testing"
+	"time"
+)
+
+// recorder - TestingT collecting failures, so assertions can be checked to fail
+type recorder struct {
+	errors []string
+}
+
+func (r *recorder) Helper() {}
+
+func (r *recorder) Errorf(format string, args ...interface{}) {
+	r.errors = append(r.errors, fmt.Sprintf(format, args...))
+}
+
+func ttlService(id string) consul.Service {
+	return consul.Service{Name: "app", ID: id, Port: 8080, Check: consul.CheckOptions{TTL: "10s"}}
+}
+
+func TestRegisterTTLDeregister(t *testing.T) {
+	f := NewBroker()
+
+	if err := f.Register(ttlService("app-1")); err != nil {
+		t.Fatalf("Register got error %v", err)
+	}
+	f.AssertRegistered(t, "app-1")
+	f.AssertCheckStatus(t, "app-1", api.HealthCritical)
+
+	if err := f.SendHealthCheck("app-1", ""); err != nil {
+		t.Fatalf("SendHealthCheck got error %v", err)
+	}
+	f.AssertCheckStatus(t, "service:app-1", api.HealthPassing)
+
+	if err := f.SendWarning("app-1", "warming up"); err != nil {
+		t.Fatalf("SendWarning got error %v", err)
+	}
+	f.AssertCheckStatus(t, "app-1", api.HealthWarning)
+
+	if err := f.SendHealthCheck("app-1", "db is down"); err != nil {
+		t.Fatalf("SendHealthCheck got error %v", err)
+	}
+	f.AssertCheckStatus(t, "app-1", api.HealthCritical)
+
+	if err := f.Deregister("app-1"); err != nil {
+		t.Fatalf("Deregister got error %v", err)
+	}
+	f.AssertDeregistered(t, "app-1")
+	if status := f.CheckStatus("app-1"); status != "" {
+		t.Errorf("check of deregistered service has status %q", status)
+	}
+	if err := f.Deregister("app-1"); err == nil {
+		t.Error("Deregister of unknown service got no error")
+	}
+}
+
+func TestSendHealthCheckWithoutTTL(t *testing.T) {
+	f := NewBroker()
+
+	service := consul.Service{Name: "app", ID: "app-1", Check: consul.CheckOptions{HTTP: "http://localhost/health", Interval: "10s"}}
+	if err := f.Register(service); err != nil {
+		t.Fatalf("Register got error %v", err)
+	}
+	if err := f.SendHealthCheck("app-1", ""); err == nil {
+		t.Error("SendHealthCheck of HTTP check got no error")
+	}
+	if err := f.SendHealthCheck("unknown", ""); err == nil {
+		t.Error("SendHealthCheck of unknown service got no error")
+	}
+}
+
+func TestFail(t *testing.T) {
+	f := NewBroker()
+	failure := errors.New("agent is down")
+
+	f.Fail("Register", failure)
+	if err := f.Register(ttlService("app-1")); err != failure {
+		t.Fatalf("Register got error %v, want %v", err, failure)
+	}
+	if _, ok := f.Service("app-1"); ok {
+		t.Error("failed Register registered the service")
+	}
+
+	f.Fail("Register", nil)
+	if err := f.Register(ttlService("app-1")); err != nil {
+		t.Fatalf("Register got error %v", err)
+	}
+	if count := f.CallCount("Register"); count != 2 {
+		t.Errorf("CallCount(Register) = %d, want 2", count)
+	}
+	calls := f.Calls()
+	if len(calls) != 2 || calls[0].Method != "Register" {
+		t.Errorf("Calls() = %v, want two Register calls", calls)
+	}
+}
+
+func TestWatchDeduplicates(t *testing.T) {
+	f := NewBroker()
+	updates, stop := f.Watch("app", "")
+	defer stop()
+
+	next := func() []consul.ServiceInstance {
+		t.Helper()
+		select {
+		case instances := <-updates:
+			return instances
+		case <-time.After(time.Second):
+			t.Fatal("no watch update")
+			return nil
+		}
+	}
+
+	if instances := next(); len(instances) != 0 {
+		t.Fatalf("first update = %v, want no instances", instances)
+	}
+
+	if err := f.Register(ttlService("app-1")); err != nil {
+		t.Fatalf("Register got error %v", err)
+	}
+	if err := f.SendHealthCheck("app-1", ""); err != nil {
+		t.Fatalf("SendHealthCheck got error %v", err)
+	}
+	instances := next()
+	if len(instances) != 1 || instances[0].ID != "app-1" {
+		t.Fatalf("update = %v, want app-1", instances)
+	}
+
+	// changes outside the passing set must not be sent again
+	if err := f.SendHealthCheck("app-1", ""); err != nil {
+		t.Fatalf("SendHealthCheck got error %v", err)
+	}
+	if err := f.KVPut("key", []byte("value")); err != nil {
+		t.Fatalf("KVPut got error %v", err)
+	}
+	select {
+	case instances := <-updates:
+		t.Fatalf("duplicate update %v", instances)
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	if err := f.SendHealthCheck("app-1", "down"); err != nil {
+		t.Fatalf("SendHealthCheck got error %v", err)
+	}
+	if instances := next(); len(instances) != 0 {
+		t.Fatalf("update = %v, want no passing instances", instances)
+	}
+
+	stop()
+	for range updates {
+	}
+}
+
+func TestAssertions(t *testing.T) {
+	f := NewBroker()
+	if err := f.Register(ttlService("app-1")); err != nil {
+		t.Fatalf("Register got error %v", err)
+	}
+
+	r := &recorder{}
+	if !f.AssertRegistered(r, "app-1") || !f.AssertCheckStatus(r, "app-1", api.HealthCritical) {
+		t.Errorf("assertions of registered service failed: %v", r.errors)
+	}
+
+	r = &recorder{}
+	if f.AssertRegistered(r, "app-2") || f.AssertDeregistered(r, "app-1") || f.AssertCheckStatus(r, "app-1", api.HealthPassing) {
+		t.Error("wrong assertions passed")
+	}
+	if len(r.errors) != 3 {
+		t.Errorf("got %d failures, want 3: %v", len(r.errors), r.errors)
+	}
+}
+
+func TestRegisterValidates(t *testing.T) {
+	tests := []struct {
+		name    string
+		service consul.Service
+	}{
+		{name: "short ttl", service: consul.Service{Name: "app", ID: "app-1", Check: consul.CheckOptions{TTL: "100ms"}}},
+		{name: "timeout exceeds interval", service: consul.Service{Name: "app", ID: "app-1", Check: consul.CheckOptions{HTTP: "http://localhost/health", Interval: "1s", Timeout: "2s"}}},
+		{name: "unknown initial status", service: consul.Service{Name: "app", ID: "app-1", Check: consul.CheckOptions{TTL: "10s", Status: "unknown"}}},
+		{name: "duplicate check IDs", service: consul.Service{Name: "app", ID: "app-1", Checks: []consul.CheckOptions{{ID: "check", TTL: "10s"}, {ID: "check", TTL: "10s"}}}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			f := NewBroker()
+			if err := f.Register(tt.service); err == nil {
+				t.Error("Register got no error")
+			}
+			if _, err := f.RegisterWithResult(tt.service); err == nil {
+				t.Error("RegisterWithResult got no error")
+			}
+			if _, ok := f.Service("app-1"); ok {
+				t.Error("invalid service was registered")
+			}
+		})
+	}
+
+	f := NewBroker()
+	f.MinTTL = 50 * time.Millisecond
+	if err := f.Register(tests[0].service); err != nil {
+		t.Errorf("Register with lower MinTTL got error %v", err)
+	}
+}
+
+func TestRegisterBatchRollsBackNewServices(t *testing.T) {
+	f := NewBroker()
+	if err := f.Register(ttlService("app-1")); err != nil {
+		t.Fatalf("Register got error %v", err)
+	}
+
+	services := []consul.Service{
+		ttlService("app-1"),
+		{Name: "worker", Port: 8081, Check: consul.CheckOptions{TTL: "10s"}},
+		{Name: "app", ID: "app-2", Check: consul.CheckOptions{TTL: "100ms"}},
+	}
+	if err := f.RegisterBatch(services, consul.BatchAllOrNothing); err == nil {
+		t.Fatal("RegisterBatch got no error")
+	}
+	f.AssertRegistered(t, "app-1")
+	f.AssertDeregistered(t, "worker")
+}
@@ -0,0 +1,211 @@
+package consultest
+
+import (
+	"bytes"
+	"context"
+	"github.com/fakofsky/consul"
+	"reflect"
+)
+
+// wait - calls poll with the broker locked each time the state changes until poll returns false or ctx is cancelled
+func (f *Broker) wait(ctx context.Context, poll func() bool) {
+	for {
+		f.Lock()
+		changed := f.changed
+		f.Unlock()
+
+		if !poll() {
+			return
+		}
+		select {
+		case <-changed:
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+func (f *Broker) WatchCatalog(ctx context.Context, onChange func(services map[string][]string)) {
+	f.record("WatchCatalog")
+
+	known := make(map[string]struct{})
+	first := true
+	f.wait(ctx, func() bool {
+		f.Lock()
+		services := make(map[string][]string)
+		for _, service := range f.services {
+			services[service.Name] = append(services[service.Name], service.Tags...)
+		}
+		f.Unlock()
+
+		appeared := first
+		first = false
+		for name := range services {
+			if _, ok := known[name]; !ok {
+				known[name] = struct{}{}
+				appeared = true
+			}
+		}
+		for name := range known {
+			if _, ok := services[name]; !ok {
+				delete(known, name)
+			}
+		}
+
+		if appeared {
+			onChange(services)
+		}
+		return true
+	})
+}
+
+func (f *Broker) WatchLocalService(ctx context.Context, serviceID string, onMissing func(serviceID string)) {
+	f.record("WatchLocalService", serviceID)
+
+	present := true
+	f.wait(ctx, func() bool {
+		f.Lock()
+		_, ok := f.services[serviceID]
+		f.Unlock()
+
+		if !ok && present {
+			onMissing(serviceID)
+		}
+		present = ok
+		return true
+	})
+}
+
+func (f *Broker) Watch(serviceName string, tag string) (<-chan []consul.ServiceInstance, func()) {
+	f.record("Watch", serviceName, tag)
+
+	updates := make(chan []consul.ServiceInstance)
+	ctx, cancel := context.WithCancel(context.Background())
+
+	go func() {
+		defer close(updates)
+
+		var last []consul.ServiceInstance
+		sent := false
+		f.wait(ctx, func() bool {
+			f.Lock()
+			instances := f.instances(serviceName, tag, true, false)
+			f.Unlock()
+
+			if sent && reflect.DeepEqual(instances, last) {
+				return true
+			}
+			select {
+			case updates <- instances:
+				last, sent = instances, true
+				return true
+			case <-ctx.Done():
+				return false
+			}
+		})
+	}()
+
+	return updates, cancel
+}
+
+func (f *Broker) WatchEvents(ctx context.Context, name string, onEvent func(payload []byte)) {
+	f.record("WatchEvents", name)
+
+	f.Lock()
+	seen := len(f.events)
+	f.Unlock()
+
+	f.wait(ctx, func() bool {
+		f.Lock()
+		events := append([]userEvent{}, f.events[seen:]...)
+		seen = len(f.events)
+		f.Unlock()
+
+		for _, event := range events {
+			if name == "" || event.name == name {
+				onEvent(event.payload)
+			}
+		}
+		return true
+	})
+}
+
+func (f *Broker) KVWatch(key string, ch chan<- []byte) (stop func(), err error) {
+	if err := f.record("KVWatch", key, ch); err != nil {
+		return nil, err
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	go func() {
+		var value []byte
+		sent := false
+		f.wait(ctx, func() bool {
+			f.Lock()
+			changed := f.kv[key]
+			f.Unlock()
+
+			if sent && (changed == nil) == (value == nil) && bytes.Equal(changed, value) {
+				return true
+			}
+			select {
+			case ch <- changed:
+				value, sent = changed, true
+				return true
+			case <-ctx.Done():
+				return false
+			}
+		})
+	}()
+
+	return cancel, nil
+}
+
+func (f *Broker) WatchKV(prefix string) (<-chan consul.KVUpdate, func()) {
+	f.record("WatchKV", prefix)
+
+	updates := make(chan consul.KVUpdate)
+	ctx, cancel := context.WithCancel(context.Background())
+
+	go func() {
+		defer close(updates)
+
+		known := make(map[string][]byte)
+		f.wait(ctx, func() bool {
+			f.Lock()
+			values := f.kvList(prefix)
+			f.Unlock()
+
+			for key, value := range values {
+				if previous, ok := known[key]; ok && bytes.Equal(previous, value) {
+					continue
+				}
+				known[key] = value
+				if !sendUpdate(ctx, updates, consul.KVUpdate{Key: key, Value: value}) {
+					return false
+				}
+			}
+			for key := range known {
+				if _, ok := values[key]; ok {
+					continue
+				}
+				delete(known, key)
+				if !sendUpdate(ctx, updates, consul.KVUpdate{Key: key, Deleted: true}) {
+					return false
+				}
+			}
+			return true
+		})
+	}()
+
+	return updates, cancel
+}
+
+// sendUpdate - sends the update unless ctx is cancelled first
+func sendUpdate(ctx context.Context, updates chan<- consul.KVUpdate, update consul.KVUpdate) bool {
+	select {
+	case updates <- update:
+		return true
+	case <-ctx.Done():
+		return false
+	}
+}
@@ -0,0 +1,281 @@
+package consul
+
+import (
+	"context"
+	"fmt"
+	"github.com/hashicorp/consul/api"
+	"net"
+	"sort"
+	"strconv"
+	"sync"
+)
+
+// ServiceInstance - discovered instance of a service
+type ServiceInstance struct {
+	ID      string
+	Name    string
+	Address string
+	Port    int
+	Tags    []string
+	Meta    map[string]string
+}
+
+// MetaWithTags - returns Meta merged with key=value tags, Meta wins on conflicts
+func (s ServiceInstance) MetaWithTags() map[string]string {
+	return MetaWithTags(s.Tags, s.Meta)
+}
+
+// Discover - returns instances of the service, only those with passing checks when onlyHealthy
+func (b *broker) Discover(serviceName string, onlyHealthy bool) ([]ServiceInstance, error) {
+	return b.discover(serviceName, "", onlyHealthy, nil, false)
+}
+
+// DiscoverByTag - returns instances of the service having the tag, only those with passing checks when passingOnly
+func (b *broker) DiscoverByTag(serviceName, tag string, passingOnly bool) ([]ServiceInstance, error) {
+	return b.discover(serviceName, tag, passingOnly, nil, false)
+}
+
+// Resolve - returns host:port of a passing instance of the service, instances are taken in turn
+func (b *broker) Resolve(serviceName string) (string, error) {
+	instances, err := b.discover(serviceName, "", true, nil, false)
+	if err != nil {
+		return "", err
+	}
+	if len(instances) == 0 {
+		return "", fmt.Errorf("service %s has no passing instances", serviceName)
+	}
+	sort.Slice(instances, func(i, j int) bool {
+		return instances[i].ID < instances[j].ID
+	})
+
+	b.Lock()
+	next := b.resolveNext[serviceName] % len(instances)
+	b.resolveNext[serviceName] = next + 1
+	b.Unlock()
+
+	instance := instances[next]
+	return net.JoinHostPort(instance.Address, strconv.Itoa(instance.Port)), nil
+}
+
+// DiscoverInDatacenter - returns instances of the service in the datacenter, instances of another datacenter
+// than the local one come with their wan tagged address when they have one
+func (b *broker) DiscoverInDatacenter(serviceName, datacenter string, onlyHealthy bool) ([]ServiceInstance, error) {
+	local, err := b.localDatacenter()
+	if err != nil {
+		return nil, fmt.Errorf("can not read local datacenter, got error %v", err)
+	}
+
+	return b.discover(serviceName, "", onlyHealthy, &api.QueryOptions{Datacenter: datacenter}, datacenter != "" && datacenter != local)
+}
+
+// discover - returns instances of the service with the tag, any when empty, using the options,
+// with wan tagged addresses when wan
+func (b *broker) discover(serviceName, tag string, onlyHealthy bool, q *api.QueryOptions, wan bool) ([]ServiceInstance, error) {
+	if onlyHealthy {
+		entries, _, err := b.client.Health().Service(serviceName, tag, true, q)
+		if err != nil {
+			return nil, fmt.Errorf("can not discover service %s, got error %v", serviceName, err)
+		}
+
+		instances := make([]ServiceInstance, 0, len(entries))
+		for _, entry := range entries {
+			instance := instanceFromEntry(entry)
+			if wan {
+				instance = withTaggedAddress(instance, entry.Service.TaggedAddresses, "wan")
+			}
+			instances = append(instances, instance)
+		}
+		return instances, nil
+	}
+
+	catalogServices, _, err := b.client.Catalog().Service(serviceName, tag, q)
+	if err != nil {
+		return nil, fmt.Errorf("can not discover service %s, got error %v", serviceName, err)
+	}
+
+	instances := make([]ServiceInstance, 0, len(catalogServices))
+	for _, catalogService := range catalogServices {
+		address := catalogService.ServiceAddress
+		if address == "" {
+			address = catalogService.Address
+		}
+		instance := ServiceInstance{
+			ID:      catalogService.ServiceID,
+			Name:    catalogService.ServiceName,
+			Address: address,
+			Port:    catalogService.ServicePort,
+			Tags:    catalogService.ServiceTags,
+			Meta:    catalogService.ServiceMeta,
+		}
+		if wan {
+			instance = withTaggedAddress(instance, catalogService.ServiceTaggedAddresses, "wan")
+		}
+		instances = append(instances, instance)
+	}
+	return instances, nil
+}
+
+// withTaggedAddress - replaces address of the instance with its tagged one when it is set
+func withTaggedAddress(instance ServiceInstance, tagged map[string]api.ServiceAddress, tag string) ServiceInstance {
+	address, ok := tagged[tag]
+	if !ok || address.Address == "" {
+		return instance
+	}
+
+	instance.Address = address.Address
+	if address.Port != 0 {
+		instance.Port = address.Port
+	}
+	return instance
+}
+
+// InstancePicker - weighted round-robin picker over passing and warning instances of a service,
+// refreshed by a background watch. Instances get their passing or warning weight by status.
+type InstancePicker struct {
+	instances []*weightedInstance
+	cancel    context.CancelFunc
+	sync.Mutex
+}
+
+type weightedInstance struct {
+	service Service
+	weight  int
+	current int
+}
+
+// ResolveService - returns picker over available instances of the service, Close stops its watch
+func (b *broker) ResolveService(name string) (*InstancePicker, error) {
+	entries, meta, err := b.client.Health().Service(name, "", false, nil)
+	if err != nil {
+		return nil, fmt.Errorf("can not discover service %s, got error %v", name, err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	picker := &InstancePicker{cancel: cancel}
+	picker.update(entries)
+
+	go watchLoop(ctx, meta.LastIndex, func(q *api.QueryOptions) (uint64, error) {
+		entries, meta, err := b.client.Health().Service(name, "", false, q)
+		if err != nil {
+			return 0, err
+		}
+		picker.update(entries)
+		return meta.LastIndex, nil
+	})
+
+	return picker, nil
+}
+
+// Next - returns the next instance using smooth weighted round-robin, zero Service when none is available
+func (p *InstancePicker) Next() Service {
+	p.Lock()
+	defer p.Unlock()
+
+	var best *weightedInstance
+	total := 0
+	for _, instance := range p.instances {
+		instance.current += instance.weight
+		total += instance.weight
+		if best == nil || instance.current > best.current {
+			best = instance
+		}
+	}
+	if best == nil {
+		return Service{}
+	}
+
+	best.current -= total
+	return best.service
+}
+
+// Instances - returns the current available instances
+func (p *InstancePicker) Instances() []Service {
+	p.Lock()
+	defer p.Unlock()
+
+	services := make([]Service, 0, len(p.instances))
+	for _, instance := range p.instances {
+		services = append(services, instance.service)
+	}
+	return services
+}
+
+// Close - stops the background watch
+func (p *InstancePicker) Close() {
+	p.cancel()
+}
+
+func (p *InstancePicker) update(entries []*api.ServiceEntry) {
+	instances := make([]*weightedInstance, 0, len(entries))
+	for _, entry := range entries {
+		weight := entry.Service.Weights.Passing
+		switch entry.Checks.AggregatedStatus() {
+		case api.HealthCritical, api.HealthMaint:
+			continue
+		case api.HealthWarning:
+			weight = entry.Service.Weights.Warning
+		}
+		if weight <= 0 {
+			continue
+		}
+		instances = append(instances, &weightedInstance{service: serviceFromEntry(entry), weight: weight})
+	}
+
+	p.Lock()
+	p.instances = instances
+	p.Unlock()
+}
+
+// serviceFromEntry - maps health entry to Service, an instance without address is reachable at its node address
+func serviceFromEntry(entry *api.ServiceEntry) Service {
+	address := entry.Service.Address
+	if address == "" {
+		address = entry.Node.Address
+	}
+
+	return Service{
+		Name:    entry.Service.Service,
+		ID:      entry.Service.ID,
+		Address: address,
+		Port:    entry.Service.Port,
+		Tags:    entry.Service.Tags,
+		Meta:    entry.Service.Meta,
+		Weights: &Weights{
+			Passing: entry.Service.Weights.Passing,
+			Warning: entry.Service.Weights.Warning,
+		},
+	}
+}
+
+func instanceFromEntry(entry *api.ServiceEntry) ServiceInstance {
+	service := serviceFromEntry(entry)
+	return ServiceInstance{
+		ID:      service.ID,
+		Name:    service.Name,
+		Address: service.Address,
+		Port:    service.Port,
+		Tags:    service.Tags,
+		Meta:    service.Meta,
+	}
+}
+
+// ServiceHealthScore - counts instances of the service by aggregated check status, maintenance counts as critical
+func (b *broker) ServiceHealthScore(serviceName string) (passing, warning, critical int, err error) {
+	entries, _, err := b.client.Health().Service(serviceName, "", false, nil)
+	if err != nil {
+		return 0, 0, 0, fmt.Errorf("can not discover service %s, got error %v", serviceName, err)
+	}
+
+	for _, entry := range entries {
+		switch entry.Checks.AggregatedStatus() {
+		case api.HealthPassing:
+			passing++
+		case api.HealthWarning:
+			warning++
+		default:
+			critical++
+		}
+	}
+
+	return passing, warning, critical, nil
+}
@@ -0,0 +1,62 @@
+package consul
+
+import (
+	"github.com/hashicorp/consul/api"
+	"strings"
+	"testing"
+)
+
+func serviceEntry(id, status string, passing, warning int) *api.ServiceEntry {
+	check := &api.HealthCheck{Status: status}
+	if status == api.HealthMaint {
+		check = &api.HealthCheck{CheckID: api.ServiceMaintPrefix + id, Status: api.HealthCritical}
+	}
+
+	return &api.ServiceEntry{
+		Node:    &api.Node{Address: "10.0.0.1"},
+		Service: &api.AgentService{ID: id, Service: "app", Weights: api.AgentWeights{Passing: passing, Warning: warning}},
+		Checks:  api.HealthChecks{check},
+	}
+}
+
+func TestInstancePickerNext(t *testing.T) {
+	tests := []struct {
+		name    string
+		entries []*api.ServiceEntry
+		want    []string
+	}{
+		{name: "smooth weighted", entries: []*api.ServiceEntry{
+			serviceEntry("a", api.HealthPassing, 5, 1),
+			serviceEntry("b", api.HealthPassing, 1, 1),
+			serviceEntry("c", api.HealthPassing, 1, 1),
+		}, want: strings.Fields("a a b a c a a a a b a c a a")},
+		{name: "warning weight", entries: []*api.ServiceEntry{
+			serviceEntry("a", api.HealthPassing, 2, 1),
+			serviceEntry("b", api.HealthWarning, 2, 1),
+		}, want: strings.Fields("a b a a b a")},
+		{name: "unavailable skipped", entries: []*api.ServiceEntry{
+			serviceEntry("a", api.HealthPassing, 1, 1),
+			serviceEntry("b", api.HealthCritical, 1, 1),
+			serviceEntry("c", api.HealthMaint, 1, 1),
+			serviceEntry("d", api.HealthWarning, 1, 0),
+		}, want: strings.Fields("a a a")},
+		{name: "none available", entries: []*api.ServiceEntry{
+			serviceEntry("a", api.HealthCritical, 1, 1),
+		}, want: []string{"", ""}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			picker := &InstancePicker{}
+			picker.update(tt.entries)
+
+			picked := make([]string, len(tt.want))
+			for i := range picked {
+				picked[i] = picker.Next().ID
+			}
+			if strings.Join(picked, ",") != strings.Join(tt.want, ",") {
+				t.Errorf("picked %q, want %q", picked, tt.want)
+			}
+		})
+	}
+}
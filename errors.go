@@ -0,0 +1,62 @@
+package consul
+
+import (
+	"errors"
+	"github.com/hashicorp/consul/api"
+	"net/http"
+	"strings"
+)
+
+// ErrConsulDisabled - returned by GetBroker when consul is disabled by WithEnabled or CONSUL_ environment variables,
+// the nil broker is then fine for NewWrapper, which is disabled by the same rule
+var ErrConsulDisabled = errors.New("consul is disabled")
+
+// isNotFound - reports whether consul answered 404
+func isNotFound(err error) bool {
+	var statusErr api.StatusError
+	return errors.As(err, &statusErr) && statusErr.Code == http.StatusNotFound
+}
+
+// isUnavailable - reports whether the error means consul could not serve the request,
+// client errors like unknown service or ACL denial prove the agent is reachable
+func isUnavailable(err error) bool {
+	var statusErr api.StatusError
+	if errors.As(err, &statusErr) {
+		return statusErr.Code >= http.StatusInternalServerError
+	}
+	return err != nil
+}
+
+// multiError - errors of independent steps reported together
+type multiError []error
+
+func (m multiError) Error() string {
+	messages := make([]string, 0, len(m))
+	for _, err := range m {
+		messages = append(messages, err.Error())
+	}
+	return strings.Join(messages, "; ")
+}
+
+// Unwrap - lets errors.Is and errors.As see every error
+func (m multiError) Unwrap() []error {
+	return m
+}
+
+// joinErrors - returns nil when all errs are nil, the single error or multiError otherwise
+func joinErrors(errs ...error) error {
+	var joined multiError
+	for _, err := range errs {
+		if err != nil {
+			joined = append(joined, err)
+		}
+	}
+
+	switch len(joined) {
+	case 0:
+		return nil
+	case 1:
+		return joined[0]
+	}
+	return joined
+}
@@ -0,0 +1,43 @@
+package consul
+
+import (
+	"context"
+	"github.com/hashicorp/consul/api"
+	"sort"
+)
+
+// FireEvent - fires user event with the payload to the cluster
+func (b *broker) FireEvent(name string, payload []byte) error {
+	_, _, err := b.client.Event().Fire(&api.UserEvent{Name: name, Payload: payload}, nil)
+	return err
+}
+
+// WatchEvents - calls onEvent with payloads of user events fired after the watch started.
+// Blocks until ctx is cancelled, failed queries are retried.
+func (b *broker) WatchEvents(ctx context.Context, name string, onEvent func(payload []byte)) {
+	var lastLTime uint64
+	first := true
+
+	watchLoop(ctx, 0, func(q *api.QueryOptions) (uint64, error) {
+		events, meta, err := b.client.Event().List(name, q)
+		if err != nil {
+			return 0, err
+		}
+
+		sort.Slice(events, func(i, j int) bool {
+			return events[i].LTime < events[j].LTime
+		})
+		for _, event := range events {
+			if event.LTime <= lastLTime {
+				continue
+			}
+			lastLTime = event.LTime
+			if !first {
+				onEvent(event.Payload)
+			}
+		}
+		first = false
+
+		return meta.LastIndex, nil
+	})
+}
@@ -0,0 +1,31 @@
+package consul
+
+import (
+	"strconv"
+	"time"
+)
+
+// fileFreshnessScript - exits critical when the file ($1) is missing or older than $2 seconds,
+// stat flags differ between GNU and BSD
+const fileFreshnessScript = `mtime=$(stat -c %Y "$1" 2>/dev/null || stat -f %m "$1") || exit 2
+age=$(( $(date +%s) - mtime ))
+[ "$age" -le "$2" ] || { echo "$1 is $age seconds old"; exit 2; }
+echo "$1 is $age seconds old"`
+
+// NewFileFreshnessCheck - returns script check passing while the file exists and was modified within maxAge,
+// for workers without network surface that touch a heartbeat file
+func NewFileFreshnessCheck(path string, maxAge time.Duration) CheckOptions {
+	interval := defaultHealthInterval
+	if maxAge/2 < interval {
+		interval = maxAge / 2
+	}
+	if interval < time.Second {
+		interval = time.Second
+	}
+
+	return CheckOptions{
+		Name:     "file freshness " + path,
+		Args:     []string{"sh", "-c", fileFreshnessScript, "sh", path, strconv.Itoa(int(maxAge / time.Second))},
+		Interval: interval.String(),
+	}
+}
@@ -0,0 +1,56 @@
+package consul
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"fmt"
+	"os"
+	"strconv"
+)
+
+// IDGenerator - generates service ID when NewWrapper gets an empty one
+type IDGenerator interface {
+	GenerateID(serviceName string) (string, error)
+}
+
+// IDGeneratorFunc - adapts a function to IDGenerator, e.g. to read pod name from downward API
+type IDGeneratorFunc func(serviceName string) (string, error)
+
+// GenerateID - calls f(serviceName)
+func (f IDGeneratorFunc) GenerateID(serviceName string) (string, error) {
+	return f(serviceName)
+}
+
+// HostnameIDGenerator - generates ID as <service name>-<hostname>
+type HostnameIDGenerator struct{}
+
+// GenerateID - generates ID from service name and hostname
+func (HostnameIDGenerator) GenerateID(serviceName string) (string, error) {
+	hostname, err := os.Hostname()
+	if err != nil {
+		return "", err
+	}
+	return serviceName + "-" + hostname, nil
+}
+
+// UUIDIDGenerator - generates ID as <service name>-<random uuid>
+type UUIDIDGenerator struct{}
+
+// GenerateID - generates ID from service name and random UUID v4
+func (UUIDIDGenerator) GenerateID(serviceName string) (string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	b[6] = (b[6] & 0x0f) | 0x40
+	b[8] = (b[8] & 0x3f) | 0x80
+
+	return fmt.Sprintf("%s-%x-%x-%x-%x-%x", serviceName, b[0:4], b[4:6], b[6:8], b[8:10], b[10:]), nil
+}
+
+// DeterministicServiceID - returns ID stable across restarts for the same name, host and port,
+// so a restarted service updates its registration instead of leaving a stale critical one
+func DeterministicServiceID(name, host string, port int) string {
+	sum := sha256.Sum256([]byte(name + "\x00" + host + "\x00" + strconv.Itoa(port)))
+	return fmt.Sprintf("%s-%x", name, sum[:8])
+}
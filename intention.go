@@ -0,0 +1,99 @@
+package consul
+
+import (
+	"fmt"
+	"github.com/hashicorp/consul/api"
+)
+
+// UpsertIntention - allows or denies connections from source to destination service.
+// Intentions of a destination are stored in its service-intentions config entry, updated with check-and-set.
+func (b *broker) UpsertIntention(source, destination string, allow bool) error {
+	entry, index, err := b.serviceIntentions(destination)
+	if err != nil {
+		return err
+	}
+
+	action := api.IntentionActionDeny
+	if allow {
+		action = api.IntentionActionAllow
+	}
+
+	found := false
+	for _, sourceIntention := range entry.Sources {
+		if sourceIntention.Name == source {
+			sourceIntention.Action = action
+			found = true
+		}
+	}
+	if !found {
+		entry.Sources = append(entry.Sources, &api.SourceIntention{
+			Name:   source,
+			Action: action,
+			Type:   api.IntentionSourceConsul,
+		})
+	}
+
+	written, _, err := b.client.ConfigEntries().CAS(entry, index, nil)
+	if err != nil {
+		return fmt.Errorf("can not write intention %s => %s, got error %v", source, destination, err)
+	}
+	if !written {
+		return fmt.Errorf("intentions of %s were changed concurrently", destination)
+	}
+
+	return nil
+}
+
+// DeleteIntention - removes intention from source to destination service,
+// the config entry is deleted together with its last intention
+func (b *broker) DeleteIntention(source, destination string) error {
+	entry, index, err := b.serviceIntentions(destination)
+	if err != nil {
+		return err
+	}
+
+	sources := make([]*api.SourceIntention, 0, len(entry.Sources))
+	for _, sourceIntention := range entry.Sources {
+		if sourceIntention.Name != source {
+			sources = append(sources, sourceIntention)
+		}
+	}
+	if len(sources) == len(entry.Sources) {
+		return nil
+	}
+
+	var written bool
+	if len(sources) == 0 {
+		written, _, err = b.client.ConfigEntries().DeleteCAS(api.ServiceIntentions, destination, index, nil)
+	} else {
+		entry.Sources = sources
+		written, _, err = b.client.ConfigEntries().CAS(entry, index, nil)
+	}
+	if err != nil {
+		return fmt.Errorf("can not delete intention %s => %s, got error %v", source, destination, err)
+	}
+	if !written {
+		return fmt.Errorf("intentions of %s were changed concurrently", destination)
+	}
+
+	return nil
+}
+
+// serviceIntentions - returns service-intentions entry of destination with its modify index,
+// a missing entry is returned empty with zero index so CAS creates it
+func (b *broker) serviceIntentions(destination string) (*api.ServiceIntentionsConfigEntry, uint64, error) {
+	entry, _, err := b.client.ConfigEntries().Get(api.ServiceIntentions, destination, nil)
+	if isNotFound(err) {
+		return &api.ServiceIntentionsConfigEntry{Kind: api.ServiceIntentions, Name: destination}, 0, nil
+	}
+	if err != nil {
+		return nil, 0, fmt.Errorf("can not read intentions of %s, got error %v", destination, err)
+	}
+
+	intentions, ok := entry.(*api.ServiceIntentionsConfigEntry)
+	if !ok {
+		return nil, 0, fmt.Errorf("unexpected config entry %T for intentions of %s", entry, destination)
+	}
+
+	return intentions, intentions.ModifyIndex, nil
+}
@@ -0,0 +1,175 @@
+package consul
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"github.com/hashicorp/consul/api"
+)
+
+// ErrKeyNotFound - returned by KVGet when the key does not exist
+var ErrKeyNotFound = errors.New("consul key not found")
+
+// KVGet - returns value of the key, ErrKeyNotFound when the key does not exist
+func (b *broker) KVGet(key string) ([]byte, error) {
+	pair, _, err := b.client.KV().Get(key, nil)
+	if err != nil {
+		return nil, fmt.Errorf("can not read key %s, got error %v", key, err)
+	}
+	if pair == nil {
+		return nil, ErrKeyNotFound
+	}
+
+	return pair.Value, nil
+}
+
+// KVPut - writes value of the key
+func (b *broker) KVPut(key string, value []byte) error {
+	_, err := b.client.KV().Put(&api.KVPair{Key: key, Value: value}, nil)
+	if err != nil {
+		return fmt.Errorf("can not write key %s, got error %v", key, err)
+	}
+
+	return nil
+}
+
+// KVWatch - sends the current value of the key to ch and then every changed value until stop,
+// a deleted key is sent as nil. Error is returned when the key can not be read initially.
+func (b *broker) KVWatch(key string, ch chan<- []byte) (stop func(), err error) {
+	pair, meta, err := b.client.KV().Get(key, nil)
+	if err != nil {
+		return nil, fmt.Errorf("can not read key %s, got error %v", key, err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	go func() {
+		value := pairValue(pair)
+		if !sendValue(ctx, ch, value) {
+			return
+		}
+
+		watchLoop(ctx, meta.LastIndex, func(q *api.QueryOptions) (uint64, error) {
+			pair, meta, err := b.client.KV().Get(key, q)
+			if err != nil {
+				return 0, err
+			}
+
+			changed := pairValue(pair)
+			if (changed == nil) != (value == nil) || !bytes.Equal(changed, value) {
+				value = changed
+				sendValue(ctx, ch, value)
+			}
+			return meta.LastIndex, nil
+		})
+	}()
+
+	return cancel, nil
+}
+
+// pairValue - returns value of the pair, nil for a missing key and empty slice for an empty value
+func pairValue(pair *api.KVPair) []byte {
+	if pair == nil {
+		return nil
+	}
+	if pair.Value == nil {
+		return []byte{}
+	}
+
+	return pair.Value
+}
+
+// sendValue - sends value unless ctx is cancelled first
+func sendValue(ctx context.Context, ch chan<- []byte, value []byte) bool {
+	select {
+	case ch <- value:
+		return true
+	case <-ctx.Done():
+		return false
+	}
+}
+
+// KVUpdate - change of a key under the watched prefix, Deleted keys have nil Value
+type KVUpdate struct {
+	Key     string
+	Value   []byte
+	Deleted bool
+}
+
+// KVDelete - removes the key, a missing key is not an error
+func (b *broker) KVDelete(key string) error {
+	_, err := b.client.KV().Delete(key, nil)
+	if err != nil {
+		return fmt.Errorf("can not delete key %s, got error %v", key, err)
+	}
+
+	return nil
+}
+
+// KVList - returns values of all keys under the prefix
+func (b *broker) KVList(prefix string) (map[string][]byte, error) {
+	pairs, _, err := b.client.KV().List(prefix, nil)
+	if err != nil {
+		return nil, fmt.Errorf("can not list keys %s, got error %v", prefix, err)
+	}
+
+	values := make(map[string][]byte, len(pairs))
+	for _, pair := range pairs {
+		values[pair.Key] = pairValue(pair)
+	}
+	return values, nil
+}
+
+// WatchKV - sends every key under the prefix and then each change of them until stop, which closes the channel.
+// Failed queries are retried, so the channel stays quiet while consul is unavailable.
+func (b *broker) WatchKV(prefix string) (<-chan KVUpdate, func()) {
+	updates := make(chan KVUpdate)
+	ctx, cancel := context.WithCancel(context.Background())
+
+	go func() {
+		defer close(updates)
+
+		known := make(map[string]uint64)
+		watchLoop(ctx, 0, func(q *api.QueryOptions) (uint64, error) {
+			pairs, meta, err := b.client.KV().List(prefix, q)
+			if err != nil {
+				return 0, err
+			}
+
+			present := make(map[string]struct{}, len(pairs))
+			for _, pair := range pairs {
+				present[pair.Key] = struct{}{}
+				if index, ok := known[pair.Key]; ok && index == pair.ModifyIndex {
+					continue
+				}
+				known[pair.Key] = pair.ModifyIndex
+				if !sendUpdate(ctx, updates, KVUpdate{Key: pair.Key, Value: pairValue(pair)}) {
+					return meta.LastIndex, nil
+				}
+			}
+			for key := range known {
+				if _, ok := present[key]; ok {
+					continue
+				}
+				delete(known, key)
+				if !sendUpdate(ctx, updates, KVUpdate{Key: key, Deleted: true}) {
+					return meta.LastIndex, nil
+				}
+			}
+
+			return meta.LastIndex, nil
+		})
+	}()
+
+	return updates, cancel
+}
+
+// sendUpdate - sends update unless ctx is cancelled first
+func sendUpdate(ctx context.Context, updates chan<- KVUpdate, update KVUpdate) bool {
+	select {
+	case updates <- update:
+		return true
+	case <-ctx.Done():
+		return false
+	}
+}
@@ -0,0 +1,85 @@
+package consul
+
+import (
+	"context"
+	"fmt"
+	"github.com/hashicorp/consul/api"
+	"sync"
+)
+
+// Lock - distributed lock on a KV key held by a consul session, e.g. for singleton jobs or leader election.
+// The session is created on Acquire and renewed until Release.
+type Lock struct {
+	key  string
+	lock *api.Lock
+	lost <-chan struct{}
+	sync.Mutex
+}
+
+// NewLock - returns lock on the key, nothing is acquired until Acquire
+func (b *broker) NewLock(key string, opts ...LockOption) (*Lock, error) {
+	lockOptions := &api.LockOptions{Key: key}
+	for _, opt := range opts {
+		opt(lockOptions)
+	}
+
+	lock, err := b.client.LockOpts(lockOptions)
+	if err != nil {
+		return nil, fmt.Errorf("can not create lock %s, got error %v", key, err)
+	}
+
+	return &Lock{key: key, lock: lock}, nil
+}
+
+// Acquire - blocks until the lock is held or ctx is cancelled, the returned channel is closed
+// when the lock is lost, e.g. the session is invalidated
+func (l *Lock) Acquire(ctx context.Context) (<-chan struct{}, error) {
+	stop := make(chan struct{})
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		select {
+		case <-ctx.Done():
+			close(stop)
+		case <-done:
+		}
+	}()
+
+	lost, err := l.lock.Lock(stop)
+	if err != nil {
+		return nil, fmt.Errorf("can not acquire lock %s, got error %v", l.key, err)
+	}
+	if lost == nil {
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+		return nil, fmt.Errorf("lock %s is held by another session", l.key)
+	}
+
+	l.Lock()
+	l.lost = lost
+	l.Unlock()
+
+	return lost, nil
+}
+
+// Lost - returns channel closed when the held lock is lost, nil before Acquire
+func (l *Lock) Lost() <-chan struct{} {
+	l.Lock()
+	defer l.Unlock()
+
+	return l.lost
+}
+
+// Release - releases the held lock and stops renewing its session
+func (l *Lock) Release() error {
+	if err := l.lock.Unlock(); err != nil {
+		return fmt.Errorf("can not release lock %s, got error %v", l.key, err)
+	}
+
+	l.Lock()
+	l.lost = nil
+	l.Unlock()
+
+	return nil
+}
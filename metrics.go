@@ -0,0 +1,46 @@
+package consul
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+	"time"
+)
+
+// wrapperMetrics - metrics of the wrapper itself, shared by wrappers of one registerer
+type wrapperMetrics struct {
+	registrations *prometheus.CounterVec
+	heartbeats    *prometheus.CounterVec
+	latency       *prometheus.HistogramVec
+}
+
+func newWrapperMetrics(registerer prometheus.Registerer) *wrapperMetrics {
+	return &wrapperMetrics{
+		registrations: registerCollector(registerer, prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "consul_wrapper_registration_attempts_total",
+			Help: "Registration attempts of services in consul by result.",
+		}, []string{"service", "result"})).(*prometheus.CounterVec),
+		heartbeats: registerCollector(registerer, prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "consul_wrapper_heartbeats_total",
+			Help: "Health reported to TTL checks by status, failed when the agent did not accept it.",
+		}, []string{"service", "status"})).(*prometheus.CounterVec),
+		latency: registerCollector(registerer, prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Name:    "consul_wrapper_api_duration_seconds",
+			Help:    "Duration of consul API calls made by the wrapper.",
+			Buckets: prometheus.DefBuckets,
+		}, []string{"service", "operation"})).(*prometheus.HistogramVec),
+	}
+}
+
+// registerCollector - registers collector, the registered one is returned when another wrapper did it first
+func registerCollector(registerer prometheus.Registerer, collector prometheus.Collector) prometheus.Collector {
+	if err := registerer.Register(collector); err != nil {
+		if registered, ok := err.(prometheus.AlreadyRegisteredError); ok {
+			return registered.ExistingCollector
+		}
+	}
+	return collector
+}
+
+// observe - records duration of the consul call started at start
+func (m *wrapperMetrics) observe(serviceName, operation string, start time.Time) {
+	m.latency.WithLabelValues(serviceName, operation).Observe(time.Since(start).Seconds())
+}
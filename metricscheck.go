@@ -0,0 +1,77 @@
+package consul
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"strings"
+)
+
+// metricsSelfCheckTTL - TTL of the prom check fed by self scraping, a few scrape intervals
+const metricsSelfCheckTTL = 3 * metricsCheckInterval
+
+// scrapeMetrics - fetches the metrics endpoint and fails when it does not answer 200
+// or the body misses one of the expected metric names
+func scrapeMetrics(client *http.Client, metricsURL string, expected []string) error {
+	resp, err := client.Get(metricsURL)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("%s answered %s", metricsURL, resp.Status)
+	}
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+
+	var missing []string
+	for _, name := range expected {
+		if !strings.Contains(string(body), name) {
+			missing = append(missing, name)
+		}
+	}
+	if len(missing) > 0 {
+		return fmt.Errorf("%s misses metrics %s", metricsURL, strings.Join(missing, ", "))
+	}
+
+	return nil
+}
+
+// selfCheckMetrics - scrapes own metrics every metricsCheckInterval and reports the result to the prom TTL check
+// until StopMetrics
+func (w *wrapper) selfCheckMetrics() {
+	ctx, cancel := context.WithCancel(context.Background())
+
+	w.Lock()
+	if w.stopScrape != nil {
+		w.stopScrape()
+	}
+	w.stopScrape = cancel
+	w.Unlock()
+
+	client := &http.Client{Timeout: metricsCheckTimeout}
+	metricsURL := fmt.Sprintf("http://localhost:%d%s", w.monitorPort, metricsPath)
+	go func() {
+		for {
+			note := ""
+			if err := scrapeMetrics(client, metricsURL, w.metricsExpect); err != nil {
+				note = err.Error()
+			}
+			if ctx.Err() != nil {
+				return
+			}
+			if err := w.consulBroker.SendHealthCheck(w.servicePromID, note); err != nil {
+				log.Printf("can not send health check of service %s: %v", w.servicePromID, err)
+			}
+
+			if !sleepContext(ctx, metricsCheckInterval) {
+				return
+			}
+		}
+	}()
+}
@@ -0,0 +1,89 @@
+package consul
+
+import (
+	"fmt"
+	"github.com/hashicorp/consul/api"
+	"time"
+)
+
+// RegisterCheck - registers agent check not tied to any service, e.g. node level TTL signal for load balancers.
+// ID defaults to Name, TTL checks are fed by SendCheckHealth.
+func (b *broker) RegisterCheck(check CheckOptions) error {
+	check = b.withDefaults(check)
+	if check.ID == "" {
+		check.ID = check.Name
+	}
+	if check.ID == "" {
+		return fmt.Errorf("check needs ID or Name")
+	}
+	if check.empty() {
+		return fmt.Errorf("check %s has no HTTP, TCP, gRPC, script, docker, TTL or alias", check.ID)
+	}
+	if err := validateCheck(check, b.minTTL); err != nil {
+		return fmt.Errorf("invalid check %s: %v", check.ID, err)
+	}
+
+	registration := &api.AgentCheckRegistration{
+		ID:                check.ID,
+		Name:              check.Name,
+		AgentServiceCheck: *newServiceCheck(check),
+	}
+	if registration.Name == "" {
+		registration.Name = check.ID
+	}
+
+	err := b.circuit.call(func() error {
+		return b.eachAgent(func(agent *api.Agent) error {
+			return agent.CheckRegister(registration)
+		})
+	})
+	if err != nil {
+		return fmt.Errorf("can not register check %s, got error %v", check.ID, err)
+	}
+
+	if ttl, err := time.ParseDuration(check.TTL); err == nil {
+		b.Lock()
+		b.checkTTLs[check.ID] = ttl
+		b.Unlock()
+	}
+
+	return nil
+}
+
+// SendCheckHealth - reports TTL of check registered by RegisterCheck, empty error passes the check
+func (b *broker) SendCheckHealth(checkID string, checkError string) error {
+	status, output := api.HealthPassing, "ok"
+	if checkError != "" {
+		status, output = api.HealthCritical, checkError
+	}
+
+	err := b.circuit.call(func() error {
+		return b.eachAgent(func(agent *api.Agent) error {
+			return agent.UpdateTTLOpts(checkID, output, status, &api.QueryOptions{Datacenter: b.datacenter})
+		})
+	})
+	if err == nil {
+		b.touchTTL(checkID, status)
+	}
+
+	return err
+}
+
+// DeregisterCheck - removes check registered by RegisterCheck
+func (b *broker) DeregisterCheck(checkID string) error {
+	err := b.circuit.call(func() error {
+		return b.eachAgent(func(agent *api.Agent) error {
+			return agent.CheckDeregister(checkID)
+		})
+	})
+	if err != nil {
+		return fmt.Errorf("can not deregister check %s, got error %v", checkID, err)
+	}
+
+	b.Lock()
+	delete(b.checkTTLs, checkID)
+	delete(b.ttlUpdates, checkID)
+	b.Unlock()
+
+	return nil
+}
@@ -0,0 +1,399 @@
+package consul
+
+import (
+	"context"
+	"github.com/hashicorp/consul/api"
+	"github.com/prometheus/client_golang/prometheus"
+	"net"
+	"net/http"
+	"time"
+)
+
+// WrapperOption - configures wrapper created by NewWrapper
+type WrapperOption func(*wrapper)
+
+// WithIDGenerator - sets generator used when NewWrapper gets an empty service ID
+func WithIDGenerator(generator IDGenerator) WrapperOption {
+	return func(w *wrapper) {
+		w.idGenerator = generator
+	}
+}
+
+// Logger - logger used by the broker, *log.Logger satisfies it
+type Logger interface {
+	Printf(format string, v ...interface{})
+}
+
+// Option - configures broker created by NewBroker
+type Option func(*brokerOptions)
+
+type brokerOptions struct {
+	config        *api.Config
+	debugLogger   Logger
+	circuit       *circuitBreaker
+	recovery      *recovery
+	minTTL        time.Duration
+	checkDefaults CheckDefaults
+	httpTimeout   time.Duration
+	enabled       *bool
+
+	agentAddresses []string
+}
+
+// WithDebugLogger - logs every registration and deregistration request sent to the agent with its response
+func WithDebugLogger(logger Logger) Option {
+	return func(o *brokerOptions) {
+		o.debugLogger = logger
+	}
+}
+
+// WithMetricsNetwork - sets network of the metrics listener: tcp4 (default), tcp6 or tcp for dual-stack
+func WithMetricsNetwork(network string) WrapperOption {
+	return func(w *wrapper) {
+		w.metricsNet = network
+	}
+}
+
+// WithRegisterRetry - retries failed registrations up to attempts times, doubling backoff after each failure
+func WithRegisterRetry(attempts int, backoff time.Duration) WrapperOption {
+	return func(w *wrapper) {
+		if attempts < 1 {
+			attempts = 1
+		}
+		w.registerAttempts = attempts
+		w.registerBackoff = backoff
+	}
+}
+
+// WithWarmup - registers the service with warning TTL check, successful health checks keep it warning
+// until MarkReady is called, so a slow starting service is registered before it is ready to serve
+func WithWarmup() WrapperOption {
+	return func(w *wrapper) {
+		w.warmup = true
+	}
+}
+
+// WithCircuitBreaker - after threshold consecutive consul failures register, deregister and health check calls
+// fail fast with ErrCircuitOpen for cooldown, then a single call probes consul again. Threshold must be at least 1
+func WithCircuitBreaker(threshold int, cooldown time.Duration) Option {
+	return func(o *brokerOptions) {
+		o.circuit = &circuitBreaker{threshold: threshold, cooldown: cooldown}
+	}
+}
+
+// WithMetricsDeregisterGrace - makes StopMetrics mark the prom service critical and wait grace
+// before deregistering it, so in-flight scrapes complete
+func WithMetricsDeregisterGrace(grace time.Duration) WrapperOption {
+	return func(w *wrapper) {
+		w.metricsGrace = grace
+	}
+}
+
+// WithTransport - sets HTTP transport used for agent connections
+func WithTransport(transport *http.Transport) Option {
+	return func(o *brokerOptions) {
+		o.config.Transport = transport
+	}
+}
+
+// WithConnectionPool - keeps up to maxIdle idle agent connections alive with TCP keepalive period,
+// so frequent heartbeats and discovery reuse connections
+func WithConnectionPool(maxIdle int, keepAlive time.Duration) Option {
+	return func(o *brokerOptions) {
+		if o.config.Transport == nil {
+			o.config.Transport = &http.Transport{Proxy: http.ProxyFromEnvironment}
+		}
+		o.config.Transport.MaxIdleConns = maxIdle
+		o.config.Transport.MaxIdleConnsPerHost = maxIdle
+		o.config.Transport.DialContext = (&net.Dialer{
+			Timeout:   30 * time.Second,
+			KeepAlive: keepAlive,
+		}).DialContext
+	}
+}
+
+// WithDrainEndpoint - serves path on the metrics server, a request drains the service and answers 200 when done,
+// e.g. for kubernetes preStop httpGet hook
+func WithDrainEndpoint(path string, grace time.Duration) WrapperOption {
+	return func(w *wrapper) {
+		w.drainPath = path
+		w.drainGrace = grace
+	}
+}
+
+// WithWeights - registers the service with traffic weights for passing and warning state,
+// a non-zero warning weight keeps a warning instance discoverable, e.g. for canaries
+func WithWeights(passing, warning int) WrapperOption {
+	return func(w *wrapper) {
+		w.weights = &Weights{Passing: passing, Warning: warning}
+	}
+}
+
+// RequireConsul - makes NewWrapper fail when consul is disabled instead of returning a no-op wrapper
+func RequireConsul() WrapperOption {
+	return func(w *wrapper) {
+		w.requireConsul = true
+	}
+}
+
+// WithHeartbeatFailureLimit - calls onLimit with the last error once SendHealthCheck failed to reach consul
+// limit times in a row, e.g. to shut down a fail-fast workload. Heartbeat loops stop at the limit, so nil onLimit
+// only stops them.
+func WithHeartbeatFailureLimit(limit int, onLimit func(err error)) WrapperOption {
+	return func(w *wrapper) {
+		w.failureLimit = limit
+		w.onFailureLimit = onLimit
+	}
+}
+
+// WithMinTTL - sets minimum TTL of registered checks, 1s by default, shorter TTL is rejected by Register
+func WithMinTTL(minTTL time.Duration) Option {
+	return func(o *brokerOptions) {
+		o.minTTL = minTTL
+	}
+}
+
+// WithReregisterOnMissing - watches the local agent after Register and registers the service again
+// when someone else deregisters it
+func WithReregisterOnMissing() WrapperOption {
+	return func(w *wrapper) {
+		w.reregister = true
+	}
+}
+
+// WithAddress - sets agent address instead of CONSUL_HTTP_ADDR
+func WithAddress(address string) Option {
+	return func(o *brokerOptions) {
+		o.config.Address = address
+	}
+}
+
+// WithScheme - sets agent URI scheme, http or https
+func WithScheme(scheme string) Option {
+	return func(o *brokerOptions) {
+		o.config.Scheme = scheme
+	}
+}
+
+// WithToken - sets ACL token instead of CONSUL_HTTP_TOKEN
+func WithToken(token string) Option {
+	return func(o *brokerOptions) {
+		o.config.Token = token
+	}
+}
+
+// WithDatacenter - sets datacenter of all requests
+func WithDatacenter(datacenter string) Option {
+	return func(o *brokerOptions) {
+		o.config.Datacenter = datacenter
+	}
+}
+
+// WithNamespace - sets enterprise namespace of all requests
+func WithNamespace(namespace string) Option {
+	return func(o *brokerOptions) {
+		o.config.Namespace = namespace
+	}
+}
+
+// WithTLSConfig - sets TLS settings of agent connections
+func WithTLSConfig(tlsConfig api.TLSConfig) Option {
+	return func(o *brokerOptions) {
+		o.config.TLSConfig = tlsConfig
+	}
+}
+
+// WithCheckDefaults - sets check TTL, interval and timeout registrations inherit unless they set their own
+func WithCheckDefaults(defaults CheckDefaults) Option {
+	return func(o *brokerOptions) {
+		o.checkDefaults = defaults
+	}
+}
+
+// WithAdditionalAgents - fans registration, deregistration and health checks out to more agents, e.g. a standby,
+// calls succeed while at least one agent accepts them
+func WithAdditionalAgents(addresses ...string) Option {
+	return func(o *brokerOptions) {
+		o.agentAddresses = append(o.agentAddresses, addresses...)
+	}
+}
+
+// WithStartupGrace - registers the service passing and keeps reporting it healthy for grace after Register,
+// so caches can warm up before real health checks are required
+func WithStartupGrace(grace time.Duration) WrapperOption {
+	return func(w *wrapper) {
+		w.startupGrace = grace
+	}
+}
+
+// WithLazyRegister - defers registration of Register until the first passing SendHealthCheck,
+// so the service appears in the catalog only once it is ready
+func WithLazyRegister() WrapperOption {
+	return func(w *wrapper) {
+		w.lazy = true
+	}
+}
+
+// WithMetricsSelfCheck - replaces the HTTP check of the prom service with a TTL check fed by scraping
+// own metrics, the check fails when the body misses one of the expected metric names
+func WithMetricsSelfCheck(expected ...string) WrapperOption {
+	return func(w *wrapper) {
+		w.metricsSelf = true
+		w.metricsExpect = expected
+	}
+}
+
+// RegisterOption - configures the check of a wrapper Register call
+type RegisterOption func(*CheckOptions)
+
+// WithHTTPCheck - makes consul poll the URL every interval instead of the TTL check, SendHealthCheck becomes a no-op
+func WithHTTPCheck(url string, interval time.Duration) RegisterOption {
+	return func(c *CheckOptions) {
+		c.TTL = ""
+		c.HTTP = url
+		c.Interval = interval.String()
+	}
+}
+
+// WithCheckTTL - sets TTL of the check instead of the default 5s
+func WithCheckTTL(ttl time.Duration) RegisterOption {
+	return func(c *CheckOptions) {
+		c.TTL = ttl.String()
+	}
+}
+
+// WithDeregisterCriticalAfter - makes the agent deregister the service critical for longer than after
+func WithDeregisterCriticalAfter(after time.Duration) RegisterOption {
+	return func(c *CheckOptions) {
+		c.DeregisterCriticalServiceAfter = after.String()
+	}
+}
+
+// WithMetricsWhen - starts metrics server and registers the prom service only when condition holds
+// at StartMetrics, e.g. an env flag set where prometheus scrapes
+func WithMetricsWhen(condition func() bool) WrapperOption {
+	return func(w *wrapper) {
+		w.metricsWhen = condition
+	}
+}
+
+// WithHealthFunc - makes Register start heartbeat reporting the result of health every TTL/2,
+// so the service supplies health logic only and the wrapper owns timing and status mapping
+func WithHealthFunc(health func(ctx context.Context) error) WrapperOption {
+	return func(w *wrapper) {
+		w.healthFunc = health
+	}
+}
+
+// WithHTTPTimeout - limits agent requests to timeout, blocking queries wait at most half of it
+func WithHTTPTimeout(timeout time.Duration) Option {
+	return func(o *brokerOptions) {
+		o.httpTimeout = timeout
+	}
+}
+
+// WithEnabled - enables or disables consul for GetBroker explicitly instead of CONSUL_ environment variables
+func WithEnabled(enabled bool) Option {
+	return func(o *brokerOptions) {
+		o.enabled = &enabled
+	}
+}
+
+// WithConsulEnabled - enables or disables consul for the wrapper explicitly, over WithEnabled of the broker
+// and CONSUL_ environment variables
+func WithConsulEnabled(enabled bool) WrapperOption {
+	return func(w *wrapper) {
+		w.enabled = &enabled
+	}
+}
+
+// WithRunTags - sets tags and version Run registers the service with
+func WithRunTags(tags []string, version string) WrapperOption {
+	return func(w *wrapper) {
+		w.runTags = tags
+		w.runVersion = version
+	}
+}
+
+// WithRunMetrics - makes Run start metrics server on monitorPort registered as servicePromID
+func WithRunMetrics(monitorPort int, servicePromID string) WrapperOption {
+	return func(w *wrapper) {
+		w.monitorPort = monitorPort
+		w.servicePromID = servicePromID
+	}
+}
+
+// WithAgentRecovery - retries registrations and TTL updates up to attempts times with jittered doubling backoff
+// while the agent is unavailable, and registers a service again when the agent lost its TTL check, e.g. after restart.
+// onState, if not nil, is called with state changes.
+func WithAgentRecovery(attempts int, backoff time.Duration, onState func(serviceID string, state AgentState)) Option {
+	return func(o *brokerOptions) {
+		o.recovery = &recovery{attempts: attempts, backoff: backoff, onState: onState}
+	}
+}
+
+// LockOption - configures lock created by NewLock
+type LockOption func(*api.LockOptions)
+
+// WithLockValue - stores value in the lock key while the lock is held, e.g. ID of the leader
+func WithLockValue(value []byte) LockOption {
+	return func(o *api.LockOptions) {
+		o.Value = value
+	}
+}
+
+// WithLockSessionTTL - sets TTL of the lock session, 15s by default, the lock is lost that long after
+// the holder stops renewing it
+func WithLockSessionTTL(ttl time.Duration) LockOption {
+	return func(o *api.LockOptions) {
+		o.SessionTTL = ttl.String()
+	}
+}
+
+// WithLockMonitorRetries - keeps the lock through retries failed lock monitor queries retryTime apart,
+// so a short agent outage does not lose the lock
+func WithLockMonitorRetries(retries int, retryTime time.Duration) LockOption {
+	return func(o *api.LockOptions) {
+		o.MonitorRetries = retries
+		o.MonitorRetryTime = retryTime
+	}
+}
+
+// WithLockTryOnce - makes Acquire give up after a single wait of waitTime instead of blocking until acquired
+func WithLockTryOnce(waitTime time.Duration) LockOption {
+	return func(o *api.LockOptions) {
+		o.LockTryOnce = true
+		o.LockWaitTime = waitTime
+	}
+}
+
+// WithMetricsRegistry - serves metrics of gatherer instead of the default registry and registers
+// wrapper metrics in registerer, e.g. both being one *prometheus.Registry
+func WithMetricsRegistry(gatherer prometheus.Gatherer, registerer prometheus.Registerer) WrapperOption {
+	return func(w *wrapper) {
+		w.gatherer = gatherer
+		w.registerer = registerer
+	}
+}
+
+// WithMetricsMux - mounts metrics on the mux of the application server instead of starting own server,
+// StartMetrics then registers the prom service on the port the application serves the mux
+func WithMetricsMux(mux *http.ServeMux) WrapperOption {
+	return func(w *wrapper) {
+		w.metricsMux = mux
+	}
+}
+
+// WithMeta - registers the app service with meta, e.g. git sha or zone read by routing
+func WithMeta(meta map[string]string) WrapperOption {
+	return func(w *wrapper) {
+		w.serviceMeta = meta
+	}
+}
+
+// WithConnect - registers the app service in the mesh, as connect native for ConnectTLSConfig or with a sidecar
+func WithConnect(connect ConnectOptions) WrapperOption {
+	return func(w *wrapper) {
+		w.connect = &connect
+	}
+}
@@ -0,0 +1,115 @@
+package consul
+
+import (
+	"fmt"
+	"github.com/hashicorp/consul/api"
+)
+
+// PrimaryTag - tag carried by the primary service of an active/passive pair
+const PrimaryTag = "role=primary"
+
+// SwapPrimary - moves the primary role from fromID to toID. The election record under key is switched with
+// check-and-set, so the swap fails unless the record still holds fromID (empty fromID expects no primary yet).
+// The record is the authority on which service is primary: PrimaryTag follows it and is added to toID
+// before it is removed from fromID, so for a moment both carry the tag but never none. When retagging fails
+// the tags and the record are rolled back. Both services must be registered by this broker.
+func (b *broker) SwapPrimary(key, fromID, toID string) error {
+	if fromID != "" && b.registration(fromID) == nil {
+		return fmt.Errorf("service %s is not registered by this broker", fromID)
+	}
+	if b.registration(toID) == nil {
+		return fmt.Errorf("service %s is not registered by this broker", toID)
+	}
+
+	pair, _, err := b.client.KV().Get(key, nil)
+	if err != nil {
+		return fmt.Errorf("can not read primary record %s, got error %v", key, err)
+	}
+
+	var index uint64
+	current := ""
+	if pair != nil {
+		index = pair.ModifyIndex
+		current = string(pair.Value)
+	}
+	if current != fromID {
+		return fmt.Errorf("primary record %s holds %q, expected %q", key, current, fromID)
+	}
+
+	swapped, _, err := b.client.KV().CAS(&api.KVPair{Key: key, Value: []byte(toID), ModifyIndex: index}, nil)
+	if err != nil {
+		return fmt.Errorf("can not write primary record %s, got error %v", key, err)
+	}
+	if !swapped {
+		return fmt.Errorf("primary record %s was changed concurrently", key)
+	}
+
+	if err := b.retag(toID, []string{PrimaryTag}, nil); err != nil {
+		return b.rollbackPrimary(key, fromID, toID, fmt.Errorf("can not promote %s: %v", toID, err))
+	}
+	if fromID != "" {
+		if err := b.retag(fromID, nil, []string{PrimaryTag}); err != nil {
+			cause := fmt.Errorf("can not demote %s: %v", fromID, err)
+			if err := b.retag(toID, nil, []string{PrimaryTag}); err != nil {
+				return fmt.Errorf("%v, can not demote %s back: %v, primary record %s holds %s", cause, toID, err, key, toID)
+			}
+			return b.rollbackPrimary(key, fromID, toID, cause)
+		}
+	}
+
+	return nil
+}
+
+// rollbackPrimary - switches the primary record back from toID to fromID after failed retagging,
+// the record is left alone when it was changed since the swap
+func (b *broker) rollbackPrimary(key, fromID, toID string, cause error) error {
+	pair, _, err := b.client.KV().Get(key, nil)
+	if err != nil {
+		return fmt.Errorf("%v, can not read primary record %s to roll it back, got error %v", cause, key, err)
+	}
+	if pair == nil || string(pair.Value) != toID {
+		return fmt.Errorf("%v, primary record %s was changed concurrently and is not rolled back", cause, key)
+	}
+
+	var rolledBack bool
+	if fromID == "" {
+		rolledBack, _, err = b.client.KV().DeleteCAS(&api.KVPair{Key: key, ModifyIndex: pair.ModifyIndex}, nil)
+	} else {
+		rolledBack, _, err = b.client.KV().CAS(&api.KVPair{Key: key, Value: []byte(fromID), ModifyIndex: pair.ModifyIndex}, nil)
+	}
+	if err != nil {
+		return fmt.Errorf("%v, can not roll back primary record %s, got error %v", cause, key, err)
+	}
+	if !rolledBack {
+		return fmt.Errorf("%v, primary record %s was changed concurrently and is not rolled back", cause, key)
+	}
+
+	return fmt.Errorf("%v, primary record %s rolled back to %q", cause, key, fromID)
+}
+
+// retag - re-registers cached service with tags added and removed, keeping its checks
+func (b *broker) retag(serviceID string, add, remove []string) error {
+	serviceRegData := b.reregistration(serviceID)
+	if serviceRegData == nil {
+		return fmt.Errorf("service %s is not registered by this broker", serviceID)
+	}
+
+	tags := make([]string, 0, len(serviceRegData.Tags)+len(add))
+	for _, tag := range serviceRegData.Tags {
+		if !containsTag(remove, tag) && !containsTag(add, tag) {
+			tags = append(tags, tag)
+		}
+	}
+	serviceRegData.Tags = append(tags, add...)
+
+	return b.register(serviceRegData, b.queryOptions(serviceID).Token)
+}
+
+func containsTag(tags []string, tag string) bool {
+	for _, t := range tags {
+		if t == tag {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,119 @@
+package consul
+
+import (
+	"errors"
+	"fmt"
+	"github.com/hashicorp/consul/api"
+	"math/rand"
+	"strings"
+	"sync"
+	"time"
+)
+
+// AgentState - state of the agent connection reported by WithAgentRecovery
+type AgentState string
+
+const (
+	// AgentAvailable - the agent answers requests
+	AgentAvailable AgentState = "available"
+	// AgentUnavailable - requests fail to reach the agent and are retried
+	AgentUnavailable AgentState = "unavailable"
+	// AgentReregistered - the agent lost a service, e.g. after restart, and the broker registered it again
+	AgentReregistered AgentState = "reregistered"
+)
+
+// recovery - retry settings of WithAgentRecovery
+type recovery struct {
+	attempts int
+	backoff  time.Duration
+	onState  func(serviceID string, state AgentState)
+	state    AgentState
+	sync.Mutex
+}
+
+// report - calls onState when the state changed, reregistrations are reported every time
+func (r *recovery) report(serviceID string, state AgentState) {
+	r.Lock()
+	changed := r.state != state || state == AgentReregistered
+	r.state = state
+	r.Unlock()
+
+	if changed && r.onState != nil {
+		r.onState(serviceID, state)
+	}
+}
+
+// retry - runs call again with jittered doubling backoff while the agent is unavailable, up to recovery attempts.
+// An open circuit breaker fails at once, so retries do not defeat its fast fail.
+func (b *broker) retry(serviceID string, call func() error) error {
+	if b.recovery == nil {
+		return call()
+	}
+
+	backoff := b.recovery.backoff
+	for attempt := 1; ; attempt++ {
+		err := call()
+		if errors.Is(err, ErrCircuitOpen) {
+			return err
+		}
+		if !isUnavailable(err) {
+			b.recovery.report(serviceID, AgentAvailable)
+			return err
+		}
+
+		b.recovery.report(serviceID, AgentUnavailable)
+		if attempt >= b.recovery.attempts {
+			return err
+		}
+		time.Sleep(jitter(backoff))
+		if backoff *= 2; backoff > watchMaxBackoff {
+			backoff = watchMaxBackoff
+		}
+	}
+}
+
+// reregister - registers the cached service again after the agent lost it
+func (b *broker) reregister(serviceID string) error {
+	serviceRegData := b.reregistration(serviceID)
+	if serviceRegData == nil {
+		return fmt.Errorf("service %s is not registered by this broker", serviceID)
+	}
+
+	if err := b.register(serviceRegData, b.queryOptions(serviceID).Token); err != nil {
+		return fmt.Errorf("can not register service %s again, got error %v", serviceID, err)
+	}
+	b.recovery.report(serviceID, AgentReregistered)
+
+	return nil
+}
+
+// reregisterOn - registers the service again on the one agent that lost it, e.g. a restarted standby,
+// and sends the TTL update the agent missed
+func (b *broker) reregisterOn(agent *api.Agent, serviceID, output, status string) error {
+	serviceRegData := b.reregistration(serviceID)
+	if serviceRegData == nil {
+		return fmt.Errorf("service %s is not registered by this broker", serviceID)
+	}
+
+	options := b.queryOptions(serviceID)
+	if err := agent.ServiceRegisterOpts(serviceRegData, api.ServiceRegisterOpts{Token: options.Token}); err != nil {
+		return fmt.Errorf("can not register service %s again, got error %v", serviceID, err)
+	}
+	b.recovery.report(serviceID, AgentReregistered)
+
+	return agent.UpdateTTLOpts("service:"+serviceID, output, status, options)
+}
+
+// isMissingTTL - reports whether the agent does not know the TTL check, e.g. after restart without persisted state
+func isMissingTTL(err error) bool {
+	return err != nil && (isNotFound(err) || strings.Contains(err.Error(), "does not have associated TTL"))
+}
+
+// jitter - returns random duration between half and full backoff, so restarted agents are not hit at once
+func jitter(backoff time.Duration) time.Duration {
+	if backoff <= 1 {
+		return backoff
+	}
+
+	return backoff/2 + time.Duration(rand.Int63n(int64(backoff/2)))
+}
@@ -0,0 +1,82 @@
+package consul
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+const (
+	defaultHealthPath     = "/health"
+	defaultHealthInterval = 10 * time.Second
+)
+
+// HTTPServerOptions - settings of RegisterHTTPServer
+type HTTPServerOptions struct {
+	// Broker is used for registration, GetBroker is called when it is nil
+	Broker      Broker
+	ServiceName string
+	ServiceID   string
+	Tags        []string
+	Version     string
+	// HealthPath is polled by consul HTTP check every HealthInterval, /health and 10s by default
+	HealthPath     string
+	HealthInterval time.Duration
+	// MonitorPort starts metrics server registered as ServicePromID when non-zero
+	MonitorPort   int
+	ServicePromID string
+	Options       []WrapperOption
+}
+
+// RegisterHTTPServer - creates wrapper for the server about to start, registers it with HTTP check
+// of its health path and starts metrics server
+func RegisterHTTPServer(srv *http.Server, opts HTTPServerOptions) (Wrapper, error) {
+	scheme, defaultAddr := "http", ":80"
+	if srv.TLSConfig != nil {
+		scheme, defaultAddr = "https", ":443"
+	}
+	addr := srv.Addr
+	if addr == "" {
+		addr = defaultAddr
+	}
+
+	consulBroker := opts.Broker
+	if consulBroker == nil {
+		var err error
+		if consulBroker, err = GetBroker(); err != nil && err != ErrConsulDisabled {
+			return nil, fmt.Errorf("can not create consul broker %v", err)
+		}
+	}
+
+	w, err := NewWrapper(addr, consulBroker, opts.ServiceName, opts.ServiceID, opts.Options...)
+	if err != nil {
+		return nil, err
+	}
+
+	healthPath := opts.HealthPath
+	if healthPath == "" {
+		healthPath = defaultHealthPath
+	}
+	healthInterval := opts.HealthInterval
+	if healthInterval == 0 {
+		healthInterval = defaultHealthInterval
+	}
+	sw := w.(*wrapper)
+	sw.serviceCheck = &CheckOptions{
+		HTTP:     fmt.Sprintf("%s://%s%s", scheme, net.JoinHostPort(sw.checkHost(), strconv.Itoa(sw.servicePort)), healthPath),
+		Interval: healthInterval.String(),
+	}
+
+	if err := w.Register(opts.Tags, opts.Version); err != nil {
+		return nil, err
+	}
+	if opts.MonitorPort != 0 {
+		if err := w.StartMetrics(opts.MonitorPort, opts.ServicePromID); err != nil {
+			return nil, joinErrors(err, w.Deregister())
+		}
+	}
+
+	return w, nil
+}
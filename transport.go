@@ -0,0 +1,130 @@
+package consul
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+const (
+	consulScheme  = "consul"
+	serviceDomain = ".service.consul"
+)
+
+// Transport - http.RoundTripper sending requests of consul://<name>/ URLs and [<tag>.]<name>.service.consul hosts
+// to passing instances of the service in turn, a request failing to dial is retried on the next instance.
+// Other requests go to Base as is.
+type Transport struct {
+	Broker Broker
+	// Base sends the resolved requests, http.DefaultTransport when nil
+	Base http.RoundTripper
+
+	next map[string]int
+	sync.Mutex
+}
+
+// NewTransport - returns transport resolving services through the broker
+func NewTransport(consulBroker Broker) *Transport {
+	return &Transport{Broker: consulBroker}
+}
+
+// RoundTrip - resolves the service of the request and sends it to one of its instances
+func (t *Transport) RoundTrip(req *http.Request) (*http.Response, error) {
+	name, tag, ok := consulService(req)
+	if !ok {
+		return t.base().RoundTrip(req)
+	}
+
+	instances, err := t.Broker.DiscoverByTag(name, tag, true)
+	if err != nil {
+		return nil, err
+	}
+	if len(instances) == 0 {
+		return nil, fmt.Errorf("service %s has no passing instances", name)
+	}
+	sort.Slice(instances, func(i, j int) bool {
+		return instances[i].ID < instances[j].ID
+	})
+
+	start := t.nextInstance(name, len(instances))
+	var dialErr error
+	for i := range instances {
+		instance := instances[(start+i)%len(instances)]
+
+		instanceReq := req.Clone(req.Context())
+		instanceReq.URL.Host = net.JoinHostPort(instance.Address, strconv.Itoa(instance.Port))
+		if instanceReq.URL.Scheme == consulScheme {
+			instanceReq.URL.Scheme = "http"
+			instanceReq.Host = ""
+		}
+		if i > 0 && req.Body != nil && req.Body != http.NoBody {
+			if req.GetBody == nil {
+				return nil, dialErr
+			}
+			if instanceReq.Body, err = req.GetBody(); err != nil {
+				return nil, err
+			}
+		}
+
+		resp, err := t.base().RoundTrip(instanceReq)
+		if err == nil || !isDialError(err) {
+			return resp, err
+		}
+		dialErr = err
+	}
+
+	return nil, dialErr
+}
+
+func (t *Transport) base() http.RoundTripper {
+	if t.Base == nil {
+		return http.DefaultTransport
+	}
+	return t.Base
+}
+
+// nextInstance - returns index of the instance to try first, instances of a service are taken in turn
+func (t *Transport) nextInstance(name string, count int) int {
+	t.Lock()
+	defer t.Unlock()
+
+	if t.next == nil {
+		t.next = make(map[string]int)
+	}
+	next := t.next[name] % count
+	t.next[name] = next + 1
+
+	return next
+}
+
+// consulService - returns service name and tag the request addresses, false for other requests
+func consulService(req *http.Request) (name, tag string, ok bool) {
+	if req.URL.Scheme == consulScheme {
+		return req.URL.Hostname(), "", true
+	}
+
+	host := req.URL.Hostname()
+	if !strings.HasSuffix(host, serviceDomain) {
+		return "", "", false
+	}
+
+	labels := strings.Split(strings.TrimSuffix(host, serviceDomain), ".")
+	switch len(labels) {
+	case 1:
+		return labels[0], "", true
+	case 2:
+		return labels[1], labels[0], true
+	}
+	return "", "", false
+}
+
+// isDialError - reports whether the connection could not be established, so the request was not sent
+func isDialError(err error) bool {
+	var opErr *net.OpError
+	return errors.As(err, &opErr) && opErr.Op == "dial"
+}
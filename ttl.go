@@ -0,0 +1,97 @@
+package consul
+
+import (
+	"fmt"
+	"github.com/hashicorp/consul/api"
+	"strings"
+	"time"
+)
+
+// TTLRemaining - returns time left before the TTL check expires, so heartbeats can be sent just in time.
+// The agent exposes neither TTL nor last update of a check, both are taken from what this broker
+// registered and sent: a check never updated by the broker is reported expired.
+func (b *broker) TTLRemaining(checkID string) (time.Duration, error) {
+	checks, err := b.client.Agent().Checks()
+	if err != nil {
+		return 0, fmt.Errorf("can not read checks, got error %v", err)
+	}
+	check, ok := checks[checkID]
+	if !ok {
+		return 0, fmt.Errorf("check %s is not registered in the agent", checkID)
+	}
+	if check.Type != "" && check.Type != "ttl" {
+		return 0, fmt.Errorf("check %s is %s check, not ttl", checkID, check.Type)
+	}
+
+	b.Lock()
+	defer b.Unlock()
+
+	ttl, ok := b.checkTTL(checkID)
+	if !ok {
+		return 0, fmt.Errorf("check %s was not registered by this broker", checkID)
+	}
+	updated, ok := b.ttlUpdates[checkID]
+	if !ok {
+		return 0, nil
+	}
+
+	if remaining := ttl - time.Since(updated); remaining > 0 {
+		return remaining, nil
+	}
+	return 0, nil
+}
+
+// touchTTL - records successful TTL update of the check and the status it was set to
+func (b *broker) touchTTL(checkID, status string) {
+	b.Lock()
+	defer b.Unlock()
+
+	b.ttlUpdates[checkID] = time.Now()
+	b.ttlStatuses[checkID] = status
+}
+
+// forgetTTL - drops TTL updates of the service checks, b must be locked
+func (b *broker) forgetTTL(serviceID string) {
+	for checkID := range b.ttlUpdates {
+		if isServiceCheck(serviceID, checkID) {
+			delete(b.ttlUpdates, checkID)
+		}
+	}
+	b.forgetTTLStatuses(serviceID)
+}
+
+// forgetTTLStatuses - drops statuses sent to the service checks, b must be locked
+func (b *broker) forgetTTLStatuses(serviceID string) {
+	for checkID := range b.ttlStatuses {
+		if isServiceCheck(serviceID, checkID) {
+			delete(b.ttlStatuses, checkID)
+		}
+	}
+}
+
+// isServiceCheck - reports whether the check ID is one assigned to checks of the service
+func isServiceCheck(serviceID, checkID string) bool {
+	return checkID == "service:"+serviceID || strings.HasPrefix(checkID, "service:"+serviceID+":")
+}
+
+// checkTTL - returns TTL of standalone or service check registered by the broker, b must be locked
+func (b *broker) checkTTL(checkID string) (time.Duration, bool) {
+	if ttl, ok := b.checkTTLs[checkID]; ok {
+		return ttl, true
+	}
+
+	for _, service := range b.services {
+		checks := append(api.AgentServiceChecks{service.Check}, service.Checks...)
+		for _, check := range checks {
+			if check == nil || check.TTL == "" {
+				continue
+			}
+			if matchesCheck(service, check, checkID) {
+				ttl, err := time.ParseDuration(check.TTL)
+				return ttl, err == nil
+			}
+		}
+	}
+
+	return 0, false
+}
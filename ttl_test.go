@@ -0,0 +1,31 @@
+package consul
+
+import (
+	"github.com/hashicorp/consul/api"
+	"testing"
+)
+
+func TestReregistrationKeepsLastStatus(t *testing.T) {
+	consulBroker, err := NewBroker()
+	if err != nil {
+		t.Fatalf("NewBroker got error %v", err)
+	}
+	b := consulBroker.(*broker)
+	b.remember(&api.AgentServiceRegistration{
+		ID:     "app-1",
+		Check:  &api.AgentServiceCheck{TTL: "10s", Status: api.HealthWarning},
+		Checks: api.AgentServiceChecks{{CheckID: "service:app-1:1", TTL: "10s", Status: api.HealthWarning}},
+	}, "")
+	b.touchTTL("service:app-1", api.HealthPassing)
+
+	serviceRegData := b.reregistration("app-1")
+	if status := serviceRegData.Check.Status; status != api.HealthPassing {
+		t.Errorf("check status = %q, want %q", status, api.HealthPassing)
+	}
+	if status := serviceRegData.Checks[0].Status; status != api.HealthWarning {
+		t.Errorf("status of check never updated = %q, want %q", status, api.HealthWarning)
+	}
+	if status := b.registration("app-1").Check.Status; status != api.HealthWarning {
+		t.Errorf("cached check status changed to %q", status)
+	}
+}
@@ -0,0 +1,161 @@
+package consul
+
+import (
+	"context"
+	"github.com/hashicorp/consul/api"
+	"reflect"
+	"sort"
+	"time"
+)
+
+const (
+	watchMinBackoff = time.Second
+	watchMaxBackoff = time.Minute
+)
+
+// watchLoop - runs blocking query until ctx is cancelled. The query gets options waiting on the last index
+// and returns the new one, an index going backwards resets the watch, failures are retried with doubling backoff.
+func watchLoop(ctx context.Context, index uint64, query func(q *api.QueryOptions) (uint64, error)) {
+	backoff := watchMinBackoff
+	for ctx.Err() == nil {
+		q := (&api.QueryOptions{WaitIndex: index}).WithContext(ctx)
+		newIndex, err := query(q)
+		if err != nil {
+			if !sleepContext(ctx, backoff) {
+				return
+			}
+			if backoff *= 2; backoff > watchMaxBackoff {
+				backoff = watchMaxBackoff
+			}
+			continue
+		}
+
+		backoff = watchMinBackoff
+		switch {
+		case newIndex < index:
+			index = 0
+		case newIndex == 0:
+			index = 1
+		default:
+			index = newIndex
+		}
+	}
+}
+
+// WatchCatalog - calls onChange with all catalog services and their tags, first with the current catalog
+// and then whenever a new service name appears. Blocks until ctx is cancelled, failed queries are retried.
+func (b *broker) WatchCatalog(ctx context.Context, onChange func(services map[string][]string)) {
+	known := make(map[string]struct{})
+	first := true
+
+	watchLoop(ctx, 0, func(q *api.QueryOptions) (uint64, error) {
+		services, meta, err := b.client.Catalog().Services(q)
+		if err != nil {
+			return 0, err
+		}
+
+		appeared := first
+		first = false
+		for name := range services {
+			if _, ok := known[name]; !ok {
+				known[name] = struct{}{}
+				appeared = true
+			}
+		}
+		for name := range known {
+			if _, ok := services[name]; !ok {
+				delete(known, name)
+			}
+		}
+
+		if appeared {
+			onChange(services)
+		}
+		return meta.LastIndex, nil
+	})
+}
+
+// WatchLocalService - calls onMissing when the service disappears from the local agent, e.g. deregistered
+// by an operator, and again after each reappearance. Blocks until ctx is cancelled.
+func (b *broker) WatchLocalService(ctx context.Context, serviceID string, onMissing func(serviceID string)) {
+	hash := ""
+	present := true
+	backoff := watchMinBackoff
+
+	for ctx.Err() == nil {
+		q := (&api.QueryOptions{WaitHash: hash, Token: b.queryOptions(serviceID).Token}).WithContext(ctx)
+		_, meta, err := b.client.Agent().Service(serviceID, q)
+		switch {
+		case err == nil:
+			present = true
+			hash = meta.LastContentHash
+			backoff = watchMinBackoff
+			continue
+		case isNotFound(err):
+			hash = ""
+			if present {
+				present = false
+				onMissing(serviceID)
+			}
+		}
+
+		if !sleepContext(ctx, backoff) {
+			return
+		}
+		if backoff *= 2; backoff > watchMaxBackoff {
+			backoff = watchMaxBackoff
+		}
+	}
+}
+
+// Watch - sends passing instances of the service with the tag, any when empty, first the current ones
+// and then each changed set. Identical sets are not sent again, stop closes the channel.
+func (b *broker) Watch(serviceName string, tag string) (<-chan []ServiceInstance, func()) {
+	updates := make(chan []ServiceInstance)
+	ctx, cancel := context.WithCancel(context.Background())
+
+	go func() {
+		defer close(updates)
+
+		var last []ServiceInstance
+		sent := false
+		watchLoop(ctx, 0, func(q *api.QueryOptions) (uint64, error) {
+			entries, meta, err := b.client.Health().Service(serviceName, tag, true, q)
+			if err != nil {
+				return 0, err
+			}
+
+			instances := make([]ServiceInstance, 0, len(entries))
+			for _, entry := range entries {
+				instances = append(instances, instanceFromEntry(entry))
+			}
+			sort.Slice(instances, func(i, j int) bool {
+				return instances[i].ID < instances[j].ID
+			})
+
+			if !sent || !reflect.DeepEqual(instances, last) {
+				select {
+				case updates <- instances:
+					last, sent = instances, true
+				case <-ctx.Done():
+				}
+			}
+			return meta.LastIndex, nil
+		})
+	}()
+
+	return updates, cancel
+}
+
+// sleepContext - waits d, returns false when ctx is cancelled first
+func sleepContext(ctx context.Context, d time.Duration) bool {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+
+	select {
+	case <-ctx.Done():
+		return false
+	case <-timer.C:
+		return true
+	}
+}
@@ -1,23 +1,50 @@
 package consul
 
 import (
+	"context"
+	"crypto/tls"
+	"encoding/json"
 	"fmt"
+	"github.com/hashicorp/consul/api"
 	"github.com/pkg/errors"
+	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/client_golang/prometheus/promhttp"
 	"log"
+	"net"
 	"net/http"
+	"net/url"
 	"os"
+	"os/signal"
 	"strconv"
 	"strings"
+	"sync"
+	"syscall"
 	"time"
 )
 
+const (
+	defaultServiceTTL    = 5 * time.Second
+	metricsPath          = "/metrics"
+	metricsCheckInterval = 10 * time.Second
+	metricsCheckTimeout  = 5 * time.Second
+	metricsStopTimeout   = 5 * time.Second
+)
+
 type Wrapper interface {
 	StartMetrics(monitorPort int, servicePromID string) error
 	StopMetrics() error
-	Register(tags []string, version string) error
+	Register(tags []string, version string, opts ...RegisterOption) error
 	Deregister() error
+	Drain() error
+	Discover(serviceName string, onlyHealthy bool) ([]ServiceInstance, error)
 	SendHealthCheck(err error) error
+	StartHeartbeat(ctx context.Context, interval time.Duration, check func() error) (stop func())
+	MarkReady() error
+	SetTTL(ttl time.Duration) error
+	RegistrationSpec() ([]byte, error)
+	Run(ctx context.Context) error
+	MetricsHandler() http.Handler
+	ConnectTLSConfig(ctx context.Context) (*tls.Config, error)
 }
 
 type wrapper struct {
@@ -26,168 +53,975 @@ type wrapper struct {
 	serviceID     string
 	servicePromID string
 	servicePort   int
+	serviceAddr   string
+	serviceMeta   map[string]string
+	serviceTags   []string
+	serviceTTL    time.Duration
+	weights       *Weights
+	serviceCheck  *CheckOptions
+	connect       *ConnectOptions
 	monitorPort   int
 	consulBroker  Broker
+	idGenerator   IDGenerator
+	metricsNet    string
+
+	registerAttempts int
+	registerBackoff  time.Duration
+	metricsGrace     time.Duration
+	failureLimit     int
+	onFailureLimit   func(err error)
+	failures         int
+	metricsServer    *http.Server
+	metricsMux       *http.ServeMux
+	metricsMounted   bool
+	gatherer         prometheus.Gatherer
+	registerer       prometheus.Registerer
+	metrics          *wrapperMetrics
+	metricsSelf      bool
+	metricsWhen      func() bool
+	metricsSkipped   bool
+	metricsExpect    []string
+	stopScrape       context.CancelFunc
+	drainPath        string
+	drainGrace       time.Duration
+
+	requireConsul bool
+	enabled       *bool
+	reregister    bool
+	stopWatch     context.CancelFunc
+	startupGrace  time.Duration
+	stopGrace     context.CancelFunc
+	graceUntil    time.Time
+	stopBeat      context.CancelFunc
+	healthFunc    func(ctx context.Context) error
+	runTags       []string
+	runVersion    string
+	registered    bool
+	lazy          bool
+	pending       bool
+	warmup        bool
+	warmingUp     bool
+	// checkStatus is the last status sent to the TTL check, re-registrations keep it
+	checkStatus string
+	sync.Mutex
 }
 
 func (w *wrapper) StartMetrics(monitorPort int, servicePromID string) error {
-	if !w.isUseConsul {
+	w.metricsSkipped = w.metricsWhen != nil && !w.metricsWhen()
+	if w.metricsSkipped {
+		log.Printf("metrics of service %s are disabled by condition, skip metrics server", w.serviceName)
 		return nil
 	}
-	go func() {
-		err := startMetricServer(w.serviceName, monitorPort)
-		if err != nil {
-			log.Fatal(err)
-		}
-	}()
 
 	w.monitorPort = monitorPort
 	w.servicePromID = servicePromID
 
-	promService := Service{
-		Name: w.serviceName,
-		ID:   servicePromID,
-		Port: monitorPort,
-		Tags: []string{"prom"},
+	if !w.isUseConsul {
+		return nil
+	}
+
+	if err := w.serveMetrics(monitorPort); err != nil {
+		return err
 	}
 
-	err := w.consulBroker.Register(promService)
+	promService := w.promService()
+	err := w.register(promService)
 	if err != nil {
+		w.stopMetricsServer()
 		return fmt.Errorf("can not register service %s in consul %v", promService.ID, err)
 	}
+	if w.metricsSelf {
+		w.selfCheckMetrics()
+	}
 
 	return nil
 }
 
 func (w *wrapper) StopMetrics() error {
-	if !w.isUseConsul {
+	if !w.isUseConsul || w.metricsSkipped {
 		return nil
 	}
 
-	err := w.consulBroker.Deregister(w.servicePromID)
+	if w.metricsGrace > 0 {
+		err := w.consulBroker.SetMaintenance(w.servicePromID, true, "metrics server is stopping")
+		if err != nil {
+			log.Printf("can not mark service %s critical before deregister: %v", w.servicePromID, err)
+		}
+		time.Sleep(w.metricsGrace)
+	}
+
+	w.Lock()
+	if w.stopScrape != nil {
+		w.stopScrape()
+		w.stopScrape = nil
+	}
+	w.Unlock()
+
+	var deregisterErr error
+	if err := w.consulBroker.Deregister(w.servicePromID); err != nil {
+		deregisterErr = fmt.Errorf("do not deregister consul service %s, got error %v", w.servicePromID, err)
+	}
+
+	return joinErrors(deregisterErr, w.stopMetricsServer())
+}
+
+// serveMetrics - mounts metrics on the mux of WithMetricsMux or starts own metrics server on monitorPort
+func (w *wrapper) serveMetrics(monitorPort int) error {
+	if w.metricsMux != nil {
+		if !w.metricsMounted {
+			w.metricsMux.Handle(metricsPath, w.promHandler())
+			for path, handler := range w.metricsHandlers() {
+				w.metricsMux.Handle(path, handler)
+			}
+			w.metricsMounted = true
+		}
+		return nil
+	}
+
+	if w.metricsServer != nil {
+		return fmt.Errorf("metrics server of service %s is already started", w.serviceName)
+	}
+
+	addr, err := metricsListenAddr(w.metricsNet, monitorPort)
 	if err != nil {
-		return fmt.Errorf("do not deregister consul service %s, got error %v", w.servicePromID, err)
+		return err
+	}
+
+	server := &http.Server{Addr: addr, Handler: w.MetricsHandler()}
+	started := make(chan error, 1)
+	go startMetricServer(server, w.metricsNet, started)
+	if err := <-started; err != nil {
+		return err
 	}
+	w.metricsServer = server
 
 	return nil
 }
 
-func (w *wrapper) Register(tags []string, version string) error {
-	if !w.isUseConsul {
+// MetricsHandler - returns handler of metrics and extra endpoints for applications mounting it on own server
+func (w *wrapper) MetricsHandler() http.Handler {
+	return newMetricsMux(w.serviceName, w.promHandler(), w.metricsHandlers())
+}
+
+// promHandler - serves the gatherer of WithMetricsRegistry, the default one otherwise
+func (w *wrapper) promHandler() http.Handler {
+	if w.gatherer == nil {
+		return promhttp.Handler()
+	}
+	return promhttp.HandlerFor(w.gatherer, promhttp.HandlerOpts{})
+}
+
+// stopMetricsServer - shuts the metrics server down, waiting up to metricsStopTimeout for scrapes in flight
+func (w *wrapper) stopMetricsServer() error {
+	if w.metricsServer == nil {
 		return nil
 	}
 
+	ctx, cancel := context.WithTimeout(context.Background(), metricsStopTimeout)
+	defer cancel()
+
+	err := w.metricsServer.Shutdown(ctx)
+	w.metricsServer = nil
+	if err != nil {
+		return fmt.Errorf("do not stop metrics server, got error %v", err)
+	}
+
+	return nil
+}
+
+// Register - registers the app service with TTL check fed by SendHealthCheck, options replace the check
+// for this and later registrations
+func (w *wrapper) Register(tags []string, version string, opts ...RegisterOption) error {
+	serviceTags := append([]string{}, tags...)
 	if version != "" {
-		tags = append(tags, version)
+		serviceTags = append(serviceTags, version)
+	}
+	var serviceCheck *CheckOptions
+	if len(opts) > 0 {
+		serviceCheck = &CheckOptions{TTL: w.ttl().String()}
+		for _, opt := range opts {
+			opt(serviceCheck)
+		}
 	}
 
-	appService := Service{
-		Name: w.serviceName,
-		ID:   w.serviceID,
-		Port: w.servicePort,
-		Tags: tags,
-		Check: CheckOptions{
-			TTL: time.Duration(5 * time.Second).String(),
-		},
+	w.Lock()
+	w.serviceTags = serviceTags
+	if serviceCheck != nil {
+		if ttl, err := time.ParseDuration(serviceCheck.TTL); err == nil {
+			w.serviceTTL = ttl
+		}
+		w.serviceCheck = serviceCheck
+	}
+	w.Unlock()
+
+	if !w.isUseConsul {
+		return nil
+	}
+
+	w.Lock()
+	w.warmingUp = w.warmup
+	w.pending = w.lazy
+	w.checkStatus = ""
+	if w.warmup {
+		w.checkStatus = api.HealthWarning
+	} else if w.startupGrace > 0 || w.lazy {
+		w.checkStatus = api.HealthPassing
+	}
+	w.Unlock()
+
+	if !w.lazy {
+		if err := w.registerApp(); err != nil {
+			return err
+		}
+	}
+	w.startHealthFunc()
+
+	return nil
+}
+
+// startHealthFunc - heartbeats the result of the health func every TTL/2 until Deregister,
+// each call gets a context timing out before the next heartbeat is due
+func (w *wrapper) startHealthFunc() {
+	if w.healthFunc == nil {
+		return
 	}
 
-	err := w.consulBroker.Register(appService)
+	w.StartHeartbeat(context.Background(), 0, func() error {
+		ctx, cancel := context.WithTimeout(context.Background(), w.ttl()/2)
+		defer cancel()
+
+		return w.healthFunc(ctx)
+	})
+}
+
+// registerApp - registers the app service and starts watches the options ask for
+func (w *wrapper) registerApp() error {
+	err := w.register(w.appService())
 	if err != nil {
 		return fmt.Errorf("do not deregister consul service %s, got error %v", w.serviceID, err)
 	}
+	w.Lock()
+	w.registered = true
+	w.Unlock()
+	if w.reregister {
+		w.watchRegistration()
+	}
+	if w.startupGrace > 0 {
+		w.passDuringGrace()
+	}
 
 	return nil
 }
 
+func (w *wrapper) appService() Service {
+	w.Lock()
+	defer w.Unlock()
+
+	service := Service{
+		Name:    w.serviceName,
+		ID:      w.serviceID,
+		Address: w.serviceAddr,
+		Port:    w.servicePort,
+		Tags:    w.serviceTags,
+		Meta:    w.serviceMeta,
+		Weights: w.weights,
+		Connect: w.connect,
+		Check: CheckOptions{
+			TTL: w.serviceTTL.String(),
+		},
+	}
+	if w.serviceCheck != nil {
+		service.Check = *w.serviceCheck
+		if service.Check.TTL != "" {
+			service.Check.TTL = w.serviceTTL.String()
+		}
+	}
+	if w.checkStatus != "" {
+		service.Check.Status = w.checkStatus
+	}
+
+	return service
+}
+
+func (w *wrapper) promService() Service {
+	service := Service{
+		Name:    w.serviceName,
+		ID:      w.servicePromID,
+		Address: w.serviceAddr,
+		Port:    w.monitorPort,
+		Tags:    []string{"prom"},
+		Check: CheckOptions{
+			HTTP:     fmt.Sprintf("http://%s%s", net.JoinHostPort(w.checkHost(), strconv.Itoa(w.monitorPort)), metricsPath),
+			Interval: metricsCheckInterval.String(),
+			Timeout:  metricsCheckTimeout.String(),
+		},
+	}
+	if w.metricsSelf {
+		service.Check = CheckOptions{TTL: metricsSelfCheckTTL.String()}
+	}
+
+	return service
+}
+
+// checkHost - returns host the agent runs HTTP checks against: the registered address, localhost only when unknown
+// since localhost is the loopback of the agent, not of the service
+func (w *wrapper) checkHost() string {
+	if w.serviceAddr != "" {
+		return w.serviceAddr
+	}
+	return "localhost"
+}
+
+// RegistrationSpec - returns JSON of the registrations the wrapper sends to the agent: the app service
+// with tags of the last Register call and the prom service once StartMetrics is called.
+// It works without consul, so CI can validate registrations against policy.
+func (w *wrapper) RegistrationSpec() ([]byte, error) {
+	registrations := []*api.AgentServiceRegistration{newServiceRegistration(w.appService())}
+	if w.servicePromID != "" {
+		registrations = append(registrations, newServiceRegistration(w.promService()))
+	}
+
+	return json.MarshalIndent(registrations, "", "  ")
+}
+
+// register - registers service, retrying with doubling backoff up to registerAttempts times
+func (w *wrapper) register(service Service) error {
+	backoff := w.registerBackoff
+	for attempt := 1; ; attempt++ {
+		start := time.Now()
+		err := w.consulBroker.Register(service)
+		w.metrics.observe(w.serviceName, "register", start)
+		result := "success"
+		if err != nil {
+			result = "failure"
+		}
+		w.metrics.registrations.WithLabelValues(w.serviceName, result).Inc()
+		if err == nil || attempt >= w.registerAttempts {
+			return err
+		}
+
+		log.Printf("register service %s in consul, attempt %d of %d failed: %v", service.ID, attempt, w.registerAttempts, err)
+		time.Sleep(backoff)
+		backoff *= 2
+	}
+}
+
+// Deregister - deregisters the service, no-op when it is not registered, e.g. already drained
 func (w *wrapper) Deregister() error {
 	if !w.isUseConsul {
 		return nil
 	}
 
+	w.Lock()
+	if w.stopWatch != nil {
+		w.stopWatch()
+		w.stopWatch = nil
+	}
+	if w.stopGrace != nil {
+		w.stopGrace()
+		w.stopGrace = nil
+	}
+	w.graceUntil = time.Time{}
+	if w.stopBeat != nil {
+		w.stopBeat()
+		w.stopBeat = nil
+	}
+	pending := w.pending
+	w.pending = false
+	registered := w.registered
+	w.registered = false
+	w.Unlock()
+
+	if pending || !registered {
+		return nil
+	}
+
+	start := time.Now()
 	err := w.consulBroker.Deregister(w.serviceID)
+	w.metrics.observe(w.serviceName, "deregister", start)
 	if err != nil {
+		w.Lock()
+		w.registered = true
+		w.Unlock()
 		return fmt.Errorf("do not deregister consul service %s, got error %v", w.serviceID, err)
 	}
 
 	return nil
 }
 
+// Run - registers the service with WithRunTags tags, starts metrics when WithRunMetrics is set
+// and blocks until ctx is cancelled or SIGTERM or SIGINT arrives. Then metrics server is shut down
+// and both services are deregistered, all shutdown errors are returned together.
+func (w *wrapper) Run(ctx context.Context) error {
+	ctx, stop := signal.NotifyContext(ctx, syscall.SIGTERM, os.Interrupt)
+	defer stop()
+
+	if err := w.Register(w.runTags, w.runVersion); err != nil {
+		return err
+	}
+	if w.monitorPort != 0 {
+		if err := w.StartMetrics(w.monitorPort, w.servicePromID); err != nil {
+			return joinErrors(err, w.Deregister())
+		}
+	}
+
+	<-ctx.Done()
+	log.Printf("stopping service %s: %v", w.serviceID, ctx.Err())
+
+	var metricsErr error
+	if w.monitorPort != 0 {
+		metricsErr = w.StopMetrics()
+	}
+	return joinErrors(metricsErr, w.Deregister())
+}
+
+// Discover - returns instances of the service, empty list when consul is disabled so local dev behaves the same
+func (w *wrapper) Discover(serviceName string, onlyHealthy bool) ([]ServiceInstance, error) {
+	if !w.isUseConsul {
+		return []ServiceInstance{}, nil
+	}
+
+	return w.consulBroker.Discover(serviceName, onlyHealthy)
+}
+
+// ConnectTLSConfig - returns mTLS config of the service registered as connect native, see Broker.ConnectTLSConfig
+func (w *wrapper) ConnectTLSConfig(ctx context.Context) (*tls.Config, error) {
+	if !w.isUseConsul {
+		return nil, ErrConsulDisabled
+	}
+
+	return w.consulBroker.ConnectTLSConfig(ctx, w.serviceID)
+}
+
+// watchRegistration - registers the service again whenever it disappears from the agent until Deregister
+func (w *wrapper) watchRegistration() {
+	ctx, cancel := context.WithCancel(context.Background())
+
+	w.Lock()
+	if w.stopWatch != nil {
+		w.stopWatch()
+	}
+	w.stopWatch = cancel
+	w.Unlock()
+
+	go w.consulBroker.WatchLocalService(ctx, w.serviceID, func(serviceID string) {
+		if ctx.Err() != nil {
+			return
+		}
+
+		log.Printf("service %s disappeared from consul agent, registering it again", serviceID)
+		if err := w.register(w.appService()); err != nil {
+			log.Printf("can not register service %s in consul %v", serviceID, err)
+		}
+	})
+}
+
+// passDuringGrace - reports the service healthy every TTL/2 during the startup grace,
+// so a slow starting service does not go critical before its own heartbeat begins
+func (w *wrapper) passDuringGrace() {
+	ctx, cancel := context.WithTimeout(context.Background(), w.startupGrace)
+
+	w.Lock()
+	if w.stopGrace != nil {
+		w.stopGrace()
+	}
+	w.stopGrace = cancel
+	w.graceUntil = time.Now().Add(w.startupGrace)
+	w.Unlock()
+
+	go func() {
+		defer cancel()
+		for sleepContext(ctx, w.ttl()/2) {
+			if err := w.SendHealthCheck(nil); err != nil {
+				log.Printf("can not send startup health check of service %s: %v", w.serviceID, err)
+			}
+		}
+	}()
+}
+
+// Drain - deregisters the service and waits the drain grace, so clients stop sending traffic before shutdown
+func (w *wrapper) Drain() error {
+	if !w.isUseConsul || !w.isRegistered() {
+		return nil
+	}
+
+	if err := w.Deregister(); err != nil {
+		return err
+	}
+	time.Sleep(w.drainGrace)
+
+	return nil
+}
+
+// metricsHandlers - returns extra handlers served by the metrics server
+func (w *wrapper) metricsHandlers() map[string]http.Handler {
+	handlers := make(map[string]http.Handler)
+	if w.drainPath != "" {
+		handlers[w.drainPath] = http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+			if err := w.Drain(); err != nil {
+				http.Error(rw, err.Error(), http.StatusInternalServerError)
+				return
+			}
+			rw.Write([]byte(w.serviceName + " drained"))
+		})
+	}
+
+	return handlers
+}
+
+// SendHealthCheck - reports health to TTL check, it is a no-op when consul polls the service itself.
+// With lazy register the first passing check registers the service, during the startup grace failures are not sent.
 func (w *wrapper) SendHealthCheck(err error) error {
 	if !w.isUseConsul {
 		return nil
 	}
+	if w.lazy {
+		if registered, regErr := w.registerPending(err); registered || regErr != nil {
+			return regErr
+		}
+	}
+	if !w.hasTTLCheck() {
+		return nil
+	}
+	if err != nil && w.inGrace() {
+		return nil
+	}
+
+	w.Lock()
+	warmingUp := w.warmingUp
+	w.Unlock()
 
+	var agentErr error
+	status := api.HealthPassing
+	start := time.Now()
 	if err != nil {
-		if err := w.consulBroker.SendHealthCheck(w.serviceID, err.Error()); err != nil {
-			return err
-		}
+		status = api.HealthCritical
+		agentErr = w.consulBroker.SendHealthCheck(w.serviceID, err.Error())
+	} else if warmingUp {
+		status = api.HealthWarning
+		agentErr = w.consulBroker.SendWarning(w.serviceID, "warming up")
 	} else {
-		if err := w.consulBroker.SendHealthCheck(w.serviceID, ""); err != nil {
-			return err
+		agentErr = w.consulBroker.SendHealthCheck(w.serviceID, "")
+	}
+	w.metrics.observe(w.serviceName, "heartbeat", start)
+	if agentErr != nil {
+		status = "failed"
+	} else {
+		w.setCheckStatus(status)
+	}
+	w.metrics.heartbeats.WithLabelValues(w.serviceName, status).Inc()
+	w.countHeartbeatFailure(agentErr)
+
+	return agentErr
+}
+
+// registerPending - registers a lazily registered service once its check passes,
+// failing checks keep a never healthy service out of the catalog
+func (w *wrapper) registerPending(checkErr error) (bool, error) {
+	w.Lock()
+	pending := w.pending
+	if pending && checkErr == nil {
+		w.pending = false
+	}
+	w.Unlock()
+
+	if !pending {
+		return false, nil
+	}
+	if checkErr != nil {
+		return true, nil
+	}
+
+	if err := w.registerApp(); err != nil {
+		w.Lock()
+		w.pending = true
+		w.Unlock()
+		return true, err
+	}
+
+	return true, nil
+}
+
+// StartHeartbeat - reports result of check to the TTL check every interval, TTL/2 when interval is zero,
+// until ctx is cancelled, stop is called, Deregister is called or the heartbeat failure limit is reached.
+// Notes of failing checks include how many cycles and for how long the check has been failing.
+// Stop is idempotent, a new heartbeat replaces the running one.
+func (w *wrapper) StartHeartbeat(ctx context.Context, interval time.Duration, check func() error) (stop func()) {
+	if !w.isUseConsul {
+		return func() {}
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	w.Lock()
+	if w.stopBeat != nil {
+		w.stopBeat()
+	}
+	w.stopBeat = cancel
+	w.Unlock()
+
+	go func() {
+		defer cancel()
+		var failedCycles int
+		var failingSince time.Time
+		for {
+			checkErr := check()
+			if ctx.Err() != nil {
+				return
+			}
+
+			if checkErr == nil {
+				failedCycles = 0
+			} else {
+				if failedCycles == 0 {
+					failingSince = time.Now()
+				}
+				failedCycles++
+				checkErr = escalateCheckError(checkErr, failedCycles, time.Since(failingSince))
+			}
+
+			agentErr := w.SendHealthCheck(checkErr)
+			if agentErr != nil {
+				log.Printf("can not send health check of service %s: %v", w.serviceID, agentErr)
+			}
+			if w.failureLimit > 0 && w.consecutiveFailures() >= w.failureLimit {
+				return
+			}
+
+			period := interval
+			if period <= 0 {
+				period = w.ttl() / 2
+			}
+			if !sleepContext(ctx, period) {
+				return
+			}
+		}
+	}()
+
+	return cancel
+}
+
+// escalateCheckError - annotates check error with number of failed cycles and failure duration
+func escalateCheckError(err error, cycles int, failing time.Duration) error {
+	unit := "cycles"
+	if cycles == 1 {
+		unit = "cycle"
+	}
+
+	return fmt.Errorf("%v (failing for %d %s / %s)", err, cycles, unit, failing.Round(time.Second))
+}
+
+func (w *wrapper) consecutiveFailures() int {
+	w.Lock()
+	defer w.Unlock()
+
+	return w.failures
+}
+
+func (w *wrapper) ttl() time.Duration {
+	w.Lock()
+	defer w.Unlock()
+
+	return w.serviceTTL
+}
+
+// inGrace - reports whether the startup grace is running, failing checks are not reported then
+func (w *wrapper) inGrace() bool {
+	w.Lock()
+	defer w.Unlock()
+
+	return time.Now().Before(w.graceUntil)
+}
+
+// hasTTLCheck - reports whether the app service check is fed by SendHealthCheck
+func (w *wrapper) hasTTLCheck() bool {
+	w.Lock()
+	defer w.Unlock()
+
+	return w.serviceCheck == nil || w.serviceCheck.TTL != ""
+}
+
+func (w *wrapper) isRegistered() bool {
+	w.Lock()
+	defer w.Unlock()
+
+	return w.registered
+}
+
+// countHeartbeatFailure - calls onFailureLimit, when set, once heartbeats failed failureLimit times in a row
+func (w *wrapper) countHeartbeatFailure(agentErr error) {
+	if w.failureLimit <= 0 {
+		return
+	}
+
+	w.Lock()
+	if agentErr == nil {
+		w.failures = 0
+		w.Unlock()
+		return
+	}
+	w.failures++
+	reached := w.failures == w.failureLimit
+	w.Unlock()
+
+	if reached {
+		log.Printf("heartbeat of service %s failed %d times in a row: %v", w.serviceID, w.failureLimit, agentErr)
+		if w.onFailureLimit != nil {
+			w.onFailureLimit(agentErr)
 		}
 	}
+}
+
+// SetTTL - changes TTL of the service check, a registered service is re-registered with the tags of the last Register.
+// Heartbeats started with zero interval follow the new TTL.
+func (w *wrapper) SetTTL(ttl time.Duration) error {
+	if ttl <= 0 {
+		return fmt.Errorf("ttl %s must be positive", ttl)
+	}
+	w.Lock()
+	w.serviceTTL = ttl
+	w.Unlock()
+
+	if !w.isUseConsul || !w.isRegistered() {
+		return nil
+	}
+
+	err := w.register(w.appService())
+	if err != nil {
+		return fmt.Errorf("can not register service %s with ttl %s in consul %v", w.serviceID, ttl, err)
+	}
 
 	return nil
 }
 
-func NewWrapper(listen string, consulBroker Broker, serviceName, serviceID string) (Wrapper, error) {
+// MarkReady - ends warmup started by Register with WithWarmup and sets the service check passing
+func (w *wrapper) MarkReady() error {
+	if !w.isUseConsul {
+		return nil
+	}
+
+	w.Lock()
+	w.warmingUp = false
+	w.Unlock()
+
+	if err := w.consulBroker.SendHealthCheck(w.serviceID, ""); err != nil {
+		return err
+	}
+	w.setCheckStatus(api.HealthPassing)
+
+	return nil
+}
+
+func (w *wrapper) setCheckStatus(status string) {
+	w.Lock()
+	defer w.Unlock()
+
+	w.checkStatus = status
+}
+
+// NewWrapper - creates wrapper, an empty serviceID is generated by IDGenerator (hostname based by default).
+// Consul is enabled by WithConsulEnabled, else by WithEnabled of the broker, else by CONSUL_ environment variables
+// as for GetBroker, so broker and wrapper agree. Disabled wrapper, also one without broker, is a no-op.
+func NewWrapper(listen string, consulBroker Broker, serviceName, serviceID string, opts ...WrapperOption) (Wrapper, error) {
 	servicePort, err := getServicePort(listen)
 	if err != nil {
 		return nil, fmt.Errorf("can't parse service port %s", err.Error())
 	}
 
-	return &wrapper{
+	w := &wrapper{
 		isUseConsul:  isUseConsul(),
 		serviceName:  serviceName,
 		serviceID:    serviceID,
 		servicePort:  servicePort,
+		serviceAddr:  getServiceAddress(listen),
 		consulBroker: consulBroker,
-	}, nil
+		serviceTTL:   defaultServiceTTL,
+		idGenerator:  HostnameIDGenerator{},
+		metricsNet:   "tcp4",
+
+		registerAttempts: 1,
+	}
+	if b, ok := consulBroker.(*broker); ok && b.enabled != nil {
+		w.isUseConsul = *b.enabled
+	}
+	for _, opt := range opts {
+		opt(w)
+	}
+	if w.enabled != nil {
+		w.isUseConsul = *w.enabled
+	}
+	if consulBroker == nil {
+		w.isUseConsul = false
+	}
+	if w.registerer == nil {
+		w.registerer = prometheus.DefaultRegisterer
+	}
+	w.metrics = newWrapperMetrics(w.registerer)
+
+	if w.requireConsul && !w.isUseConsul {
+		return nil, fmt.Errorf("consul is required for service %s, but disabled: no CONSUL_ environment variables set", serviceName)
+	}
+
+	if w.serviceID == "" {
+		w.serviceID, err = w.idGenerator.GenerateID(serviceName)
+		if err != nil {
+			return nil, fmt.Errorf("can't generate service ID %s", err.Error())
+		}
+	}
+
+	return w, nil
+}
+
+// GetBroker - creates broker when consul is enabled by WithEnabled or CONSUL_ environment variables,
+// returns ErrConsulDisabled when it is not, any other error means the client could not be created
+func GetBroker(opts ...Option) (Broker, error) {
+	options := &brokerOptions{config: api.DefaultConfig()}
+	for _, opt := range opts {
+		opt(options)
+	}
+	enabled := isUseConsul()
+	if options.enabled != nil {
+		enabled = *options.enabled
+	}
+
+	if !enabled {
+		return nil, ErrConsulDisabled
+	}
+
+	consulBroker, err := NewBroker(opts...)
+	if err != nil {
+		return nil, fmt.Errorf("consul is enabled, but client can not be created: %v", err)
+	}
+
+	return consulBroker, nil
 }
 
-func GetBroker() (Broker, error) {
-	if !isUseConsul() {
-		return nil, nil
+// startMetricServer - serves metrics until the server is shut down, bind result is sent to started,
+// so a busy port is reported to StartMetrics instead of exiting the process
+func startMetricServer(server *http.Server, network string, started chan<- error) {
+	log.Println("start prometheus monitoring at", network, server.Addr)
+	listener, err := net.Listen(network, server.Addr)
+	if err != nil {
+		started <- errors.WithMessage(err, "fail start http prometheus interface")
+		return
 	}
+	started <- nil
 
-	return NewBroker()
+	err = server.Serve(listener)
+	if err != nil && err != http.ErrServerClosed {
+		log.Println(errors.WithMessage(err, "fail serve http prometheus interface"))
+	}
 }
 
-func startMetricServer(serviceName string, port int) error {
-	http.Handle("/metrics", promhttp.Handler())
-	http.HandleFunc("/", func(rw http.ResponseWriter, req *http.Request) {
+// newMetricsMux - returns fresh mux of the metrics server instead of http.DefaultServeMux,
+// so metrics servers can be started and stopped repeatedly in one process
+func newMetricsMux(serviceName string, metricsHandler http.Handler, handlers map[string]http.Handler) *http.ServeMux {
+	mux := http.NewServeMux()
+	mux.Handle(metricsPath, metricsHandler)
+	for path, handler := range handlers {
+		mux.Handle(path, handler)
+	}
+	mux.HandleFunc("/", func(rw http.ResponseWriter, req *http.Request) {
 		rw.Write([]byte(serviceName + " metrics"))
 	})
 
-	addr := "0.0.0.0:" + strconv.Itoa(port)
-	log.Println("start prometheus monitoring at", addr)
-	err := http.ListenAndServe(addr, nil)
-	if err != nil {
-		return errors.WithMessage(err, "fail start http prometheus interface")
-	}
+	return mux
+}
 
-	return nil
+// metricsListenAddr - returns wildcard address of the network: tcp4 binds IPv4 only, tcp6 IPv6 only, tcp both
+func metricsListenAddr(network string, port int) (string, error) {
+	switch network {
+	case "tcp4":
+		return net.JoinHostPort("0.0.0.0", strconv.Itoa(port)), nil
+	case "tcp6":
+		return net.JoinHostPort("::", strconv.Itoa(port)), nil
+	case "tcp":
+		return net.JoinHostPort("", strconv.Itoa(port)), nil
+	}
+	return "", fmt.Errorf("unsupported metrics network %q", network)
 }
 
+// isUseConsul - reports whether consul is enabled. CONSUL_ENABLED or CONSUL_DISABLED set to a boolean
+// decides explicitly, otherwise any other non-empty variable with CONSUL_ in its name enables consul.
 func isUseConsul() bool {
+	if enabled, err := strconv.ParseBool(os.Getenv("CONSUL_ENABLED")); err == nil {
+		return enabled
+	}
+	if disabled, err := strconv.ParseBool(os.Getenv("CONSUL_DISABLED")); err == nil {
+		return !disabled
+	}
+
 	for _, environment := range os.Environ() {
-		if strings.Contains(environment, "CONSUL_") {
+		pair := strings.SplitN(environment, "=", 2)
+		if pair[0] == "CONSUL_DISABLED" {
+			continue
+		}
+		if strings.Contains(pair[0], "CONSUL_") && len(pair) == 2 && pair[1] != "" {
 			return true
 		}
 	}
 	return false
 }
 
-func getServicePort(hostPort string) (port int, err error) {
-	colon := strings.Split(hostPort, ":")
-	if len(colon) < 2 {
-		log.Println("fail parse service port. not found ':'")
-		return
+// getServicePort - parses port of host:port or URL listen spec, URL without port defaults to 80/443 by scheme.
+// Listen spec without a valid port is an error, so a service is never registered on port 0
+func getServicePort(hostPort string) (int, error) {
+	if strings.Contains(hostPort, "://") {
+		return getURLPort(hostPort)
 	}
-	port, err = strconv.Atoi(colon[1])
+
+	_, rawPort, err := net.SplitHostPort(hostPort)
 	if err != nil {
-		log.Println("fail parse service port", err)
-		return
+		return 0, err
+	}
+
+	return parsePort(rawPort)
+}
+
+func parsePort(rawPort string) (int, error) {
+	port, err := strconv.Atoi(rawPort)
+	if err != nil {
+		return 0, fmt.Errorf("port %q is not a number", rawPort)
+	}
+	if port <= 0 || port > 65535 {
+		return 0, fmt.Errorf("port %d is out of range", port)
+	}
+
+	return port, nil
+}
+
+// getServiceAddress - returns host of host:port or URL listen spec, empty for wildcard hosts
+// so the agent address is registered
+func getServiceAddress(listen string) string {
+	host := ""
+	if strings.Contains(listen, "://") {
+		if listenURL, err := url.Parse(listen); err == nil {
+			host = listenURL.Hostname()
+		}
+	} else if splitHost, _, err := net.SplitHostPort(listen); err == nil {
+		host = splitHost
+	}
+
+	if ip := net.ParseIP(host); ip != nil && ip.IsUnspecified() {
+		return ""
+	}
+	return host
+}
+
+func getURLPort(rawURL string) (int, error) {
+	listenURL, err := url.Parse(rawURL)
+	if err != nil {
+		return 0, err
+	}
+
+	if listenURL.Port() != "" {
+		return parsePort(listenURL.Port())
+	}
+
+	switch listenURL.Scheme {
+	case "http":
+		return 80, nil
+	case "https":
+		return 443, nil
 	}
-	return
+	return 0, fmt.Errorf("no port in %s and no default for scheme %q", rawURL, listenURL.Scheme)
 }
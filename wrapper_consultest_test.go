@@ -0,0 +1,55 @@
+package consul_test
+
+import (
+	"context"
+	"github.com/fakofsky/consul"
+	"github.com/fakofsky/consul/consultest"
+	"testing"
+	"time"
+)
+
+func newTestWrapper(t *testing.T, f *consultest.Broker, opts ...consul.WrapperOption) consul.Wrapper {
+	t.Helper()
+
+	w, err := consul.NewWrapper(":8080", f, "app", "app-1", append([]consul.WrapperOption{consul.WithConsulEnabled(true)}, opts...)...)
+	if err != nil {
+		t.Fatalf("NewWrapper got error %v", err)
+	}
+	return w
+}
+
+func TestRegisterDuringHeartbeat(t *testing.T) {
+	f := consultest.NewBroker()
+	w := newTestWrapper(t, f)
+	if err := w.Register(nil, "v1"); err != nil {
+		t.Fatalf("Register got error %v", err)
+	}
+
+	stop := w.StartHeartbeat(context.Background(), time.Millisecond, func() error { return nil })
+	defer stop()
+	for i := 0; i < 10; i++ {
+		if err := w.Register([]string{"canary"}, "v2", consul.WithCheckTTL(2*time.Second)); err != nil {
+			t.Fatalf("Register got error %v", err)
+		}
+	}
+	if err := w.Deregister(); err != nil {
+		t.Fatalf("Deregister got error %v", err)
+	}
+	f.AssertDeregistered(t, "app-1")
+}
+
+func TestStartupGraceIgnoresFailingHealthFunc(t *testing.T) {
+	f := consultest.NewBroker()
+	health := func(ctx context.Context) error { return context.DeadlineExceeded }
+	w := newTestWrapper(t, f, consul.WithStartupGrace(time.Minute), consul.WithHealthFunc(health))
+	if err := w.SetTTL(time.Second); err != nil {
+		t.Fatalf("SetTTL got error %v", err)
+	}
+	if err := w.Register(nil, "v1"); err != nil {
+		t.Fatalf("Register got error %v", err)
+	}
+	defer w.Deregister()
+
+	time.Sleep(700 * time.Millisecond)
+	f.AssertCheckStatus(t, "app-1", "passing")
+}
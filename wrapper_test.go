@@ -0,0 +1,110 @@
+package consul
+
+import "testing"
+
+func TestGetServicePort(t *testing.T) {
+	tests := []struct {
+		listen  string
+		port    int
+		wantErr bool
+	}{
+		{listen: ":8080", port: 8080},
+		{listen: "0.0.0.0:8080", port: 8080},
+		{listen: "[::1]:8080", port: 8080},
+		{listen: "http://example.com", port: 80},
+		{listen: "https://example.com", port: 443},
+		{listen: "https://example.com:8443", port: 8443},
+		{listen: "localhost", wantErr: true},
+		{listen: "host:notaport", wantErr: true},
+		{listen: "host:70000", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.listen, func(t *testing.T) {
+			port, err := getServicePort(tt.listen)
+			if tt.wantErr {
+				if err == nil {
+					t.Errorf("getServicePort(%q) = %d, want error", tt.listen, port)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("getServicePort(%q) got error %v", tt.listen, err)
+			}
+			if port != tt.port {
+				t.Errorf("getServicePort(%q) = %d, want %d", tt.listen, port, tt.port)
+			}
+		})
+	}
+}
+
+func TestNewWrapperEnabled(t *testing.T) {
+	tests := []struct {
+		name          string
+		env           string
+		brokerOptions []Option
+		options       []WrapperOption
+		noBroker      bool
+		enabled       bool
+	}{
+		{name: "environment enables", env: "true", enabled: true},
+		{name: "environment disables", env: "false", enabled: false},
+		{name: "broker enables", env: "false", brokerOptions: []Option{WithEnabled(true)}, enabled: true},
+		{name: "broker disables", env: "true", brokerOptions: []Option{WithEnabled(false)}, enabled: false},
+		{name: "wrapper option wins", env: "false", brokerOptions: []Option{WithEnabled(false)}, options: []WrapperOption{WithConsulEnabled(true)}, enabled: true},
+		{name: "no broker", env: "true", noBroker: true, enabled: false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Setenv("CONSUL_ENABLED", tt.env)
+
+			var consulBroker Broker
+			if !tt.noBroker {
+				var err error
+				if consulBroker, err = NewBroker(tt.brokerOptions...); err != nil {
+					t.Fatalf("NewBroker got error %v", err)
+				}
+			}
+			w, err := NewWrapper(":8080", consulBroker, "app", "app-1", tt.options...)
+			if err != nil {
+				t.Fatalf("NewWrapper got error %v", err)
+			}
+			if enabled := w.(*wrapper).isUseConsul; enabled != tt.enabled {
+				t.Errorf("wrapper enabled = %v, want %v", enabled, tt.enabled)
+			}
+		})
+	}
+}
+
+func TestNewWrapperFromConfigEnabled(t *testing.T) {
+	enabled, disabled := true, false
+	tests := []struct {
+		name    string
+		env     string
+		cfg     Config
+		enabled bool
+	}{
+		{name: "environment enables", env: "true", enabled: true},
+		{name: "environment disables", env: "false", enabled: false},
+		{name: "config enables", env: "false", cfg: Config{Enabled: &enabled}, enabled: true},
+		{name: "config disables", env: "true", cfg: Config{Enabled: &disabled}, enabled: false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Setenv("CONSUL_ENABLED", tt.env)
+
+			w, err := NewWrapperFromConfig(":8080", nil, "app", "app-1", tt.cfg)
+			if err != nil {
+				t.Fatalf("NewWrapperFromConfig got error %v", err)
+			}
+			if enabled := w.(*wrapper).isUseConsul; enabled != tt.enabled {
+				t.Errorf("wrapper enabled = %v, want %v", enabled, tt.enabled)
+			}
+			if consulBroker := w.(*wrapper).consulBroker; (consulBroker != nil) != tt.enabled {
+				t.Errorf("broker created = %v, want %v", consulBroker != nil, tt.enabled)
+			}
+		})
+	}
+}